@@ -6,14 +6,34 @@ package jpeg
 #include <stdlib.h>
 #include <stdio.h>
 #include <jpeglib.h>
+#include <jerror.h>
 
-void goPanic(char *);
+void goPanic(char *, int);
 */
 import "C"
 
+import "fmt"
+
 //export goPanic
-func goPanic(msg *C.char) {
-	panic(C.GoString(msg))
+func goPanic(msg *C.char, code C.int) {
+	switch code {
+	case C.JERR_OUT_OF_MEMORY, C.JERR_NO_BACKING_STORE:
+		// Allocations beyond max_memory_to_use end up here
+		panic(fmt.Errorf("%w: %s", ErrMemoryLimit, C.GoString(msg)))
+	}
+	panic(&CorruptError{Code: int(code), Message: C.GoString(msg)})
+}
+
+// recoverError turns a panic raised by libjpeg error handling (or our own
+// checks) into an error stored in *err. It must be deferred directly.
+func recoverError(err *error) {
+	if r := recover(); r != nil {
+		var ok bool
+		*err, ok = r.(error)
+		if !ok {
+			*err = fmt.Errorf("JPEG error: %v", r)
+		}
+	}
 }
 
 // The dimension multiple to which data buffers should be aligned.
@@ -47,6 +67,8 @@ type YUVImage struct {
 	Format        PixelFormat
 	Data          [3][]byte
 	Stride        [3]int
+	Orientation   int      // EXIF orientation (1-8), or 0 if unknown
+	Markers       []Marker // APPn and COM markers, if saved by ReadJPEG
 }
 
 // Used to ensure that the unsafe upcast magic actually works as intended
@@ -71,3 +93,100 @@ func (i *YUVImage) PlaneHeight(plane int) int {
 		return i.Height
 	}
 }
+
+// Crop returns a YUVImage referencing the given rectangle of i. No pixel data
+// is copied; the returned image shares its planes with i. Since chroma planes
+// may be subsampled, x and y are rounded down to the nearest chroma sample
+// boundary.
+func (i *YUVImage) Crop(x, y, width, height int) *YUVImage {
+	if i.Format == YUV422 || i.Format == YUV420 {
+		x &^= 1
+	}
+	if i.Format == YUV440 || i.Format == YUV420 {
+		y &^= 1
+	}
+	ret := *i
+	ret.Width = width
+	ret.Height = height
+	for plane := 0; plane < 3; plane++ {
+		if i.Data[plane] == nil {
+			continue
+		}
+		px, py := x, y
+		if plane != 0 && (i.Format == YUV422 || i.Format == YUV420) {
+			px /= 2
+		}
+		if plane != 0 && (i.Format == YUV440 || i.Format == YUV420) {
+			py /= 2
+		}
+		ret.Data[plane] = i.Data[plane][py*i.Stride[plane]+px:]
+	}
+	return &ret
+}
+
+// NewYUVImage allocates a YUVImage of the given dimensions and format, with
+// planes padded to AlignSize as expected by WriteJPEG.
+func NewYUVImage(width, height int, format PixelFormat) *YUVImage {
+	img := &YUVImage{Width: width, Height: height, Format: format}
+	components := 3
+	if format == Grayscale {
+		components = 1
+	}
+	for i := 0; i < components; i++ {
+		img.Stride[i] = pad(img.PlaneWidth(i), AlignSize) + AlignSize
+		img.Data[i] = make([]byte, img.Stride[i]*(pad(img.PlaneHeight(i), AlignSize)+AlignSize))
+	}
+	return img
+}
+
+// Fill sets every sample of each plane, including padding, to the given
+// Y, Cb and Cr values.
+func (i *YUVImage) Fill(y, cb, cr uint8) {
+	values := [3]uint8{y, cb, cr}
+	for plane := 0; plane < 3; plane++ {
+		for j := range i.Data[plane] {
+			i.Data[plane][j] = values[plane]
+		}
+	}
+}
+
+// Draw copies src into i with its top left corner at (x, y). src must have the
+// same format as i and fit within it. As with Crop, x and y are rounded down
+// to the nearest chroma sample boundary.
+func (i *YUVImage) Draw(src *YUVImage, x, y int) {
+	dst := i.Crop(x, y, src.Width, src.Height)
+	for plane := 0; plane < 3; plane++ {
+		if dst.Data[plane] == nil {
+			continue
+		}
+		width := src.PlaneWidth(plane)
+		for row := 0; row < src.PlaneHeight(plane); row++ {
+			copy(dst.Data[plane][row*dst.Stride[plane]:row*dst.Stride[plane]+width],
+				src.Data[plane][row*src.Stride[plane]:])
+		}
+	}
+}
+
+// ReplicateEdges fills the padding to the right and below the image in each
+// plane with copies of the last column and row, which is typical behavior
+// prior to JPEG compression.
+func (i *YUVImage) ReplicateEdges() {
+	for plane := 0; plane < 3; plane++ {
+		if i.Data[plane] == nil {
+			continue
+		}
+		data, stride := i.Data[plane], i.Stride[plane]
+		width, height := i.PlaneWidth(plane), i.PlaneHeight(plane)
+		paddedHeight := len(data) / stride
+		for y := 0; y < height; y++ {
+			pixel := data[y*stride+width-1]
+			for x := width; x < stride; x++ {
+				data[y*stride+x] = pixel
+			}
+		}
+		lastRow := data[stride*(height-1) : stride*height]
+		for y := height; y < paddedHeight; y++ {
+			copy(data[y*stride:], lastRow)
+		}
+	}
+}
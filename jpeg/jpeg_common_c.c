@@ -4,5 +4,5 @@ void error_panic(j_common_ptr cinfo) {
 	struct { const char *p; } a;
 	char buffer[JMSG_LENGTH_MAX];
 	(*cinfo->err->format_message) (cinfo, buffer);
-	goPanic(buffer);
+	goPanic(buffer, cinfo->err->msg_code);
 }
@@ -0,0 +1,62 @@
+package jpeg
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors returned by ReadJPEG and WriteJPEG. Use errors.Is to test for them,
+// since they may be wrapped with more detail.
+var (
+	ErrUnsupportedColorspace  = errors.New("jpeg: unsupported colorspace")
+	ErrUnsupportedSubsampling = errors.New("jpeg: unsupported color subsampling")
+	ErrEmptyInput             = errors.New("jpeg: input is empty")
+	ErrCorrupt                = errors.New("jpeg: corrupt data")
+	ErrSourceTooLarge         = errors.New("jpeg: source image exceeds the pixel limit")
+	ErrTooManyScans           = errors.New("jpeg: source image exceeds the scan limit")
+	ErrMemoryLimit            = errors.New("jpeg: decoding exceeds the memory limit")
+)
+
+// CorruptError is returned when libjpeg fails, which is almost always due to
+// invalid input data. It matches ErrCorrupt with errors.Is.
+type CorruptError struct {
+	Code    int    // libjpeg message code (J_MESSAGE_CODE)
+	Message string // libjpeg message text
+}
+
+func (e *CorruptError) Error() string {
+	return fmt.Sprintf("jpeg: %s (code %d)", e.Message, e.Code)
+}
+
+// Is reports whether target is ErrCorrupt.
+func (e *CorruptError) Is(target error) bool {
+	return target == ErrCorrupt
+}
+
+// ReadError wraps an error returned by the source io.Reader.
+type ReadError struct {
+	Err error
+}
+
+func (e *ReadError) Error() string {
+	return "jpeg: read failed: " + e.Err.Error()
+}
+
+// Unwrap returns the underlying reader error.
+func (e *ReadError) Unwrap() error {
+	return e.Err
+}
+
+// WriteError wraps an error returned by the destination io.Writer.
+type WriteError struct {
+	Err error
+}
+
+func (e *WriteError) Error() string {
+	return "jpeg: write failed: " + e.Err.Error()
+}
+
+// Unwrap returns the underlying writer error.
+func (e *WriteError) Unwrap() error {
+	return e.Err
+}
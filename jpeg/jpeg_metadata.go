@@ -0,0 +1,148 @@
+package jpeg
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// Marker codes for the segments that can be saved and re-emitted.
+const (
+	MarkerAPP0 = 0xe0
+	MarkerAPP1 = 0xe1 // EXIF and XMP
+	MarkerAPP2 = 0xe2 // ICC profile
+	MarkerCOM  = 0xfe
+)
+
+// Marker is an APPn or COM marker segment saved from a JPEG file.
+type Marker struct {
+	Marker int    // Marker code (e.g. MarkerAPP1)
+	Data   []byte // Marker payload, excluding the length field
+}
+
+// MetadataPolicy selects which saved markers WriteJPEG re-emits.
+type MetadataPolicy int
+
+// Valid MetadataPolicies
+const (
+	StripMetadata MetadataPolicy = iota // Emit no metadata
+	KeepICC                             // Emit ICC profiles only
+	KeepMetadata                        // Emit ICC profiles, EXIF, XMP and comments
+)
+
+var (
+	iccPrefix  = []byte("ICC_PROFILE\x00")
+	exifPrefix = []byte("Exif\x00\x00")
+	xmpPrefix  = []byte("http://ns.adobe.com/xap/1.0/\x00")
+)
+
+func isICC(m Marker) bool {
+	return m.Marker == MarkerAPP2 && bytes.HasPrefix(m.Data, iccPrefix)
+}
+
+// withoutICC returns markers without any ICC profiles.
+func withoutICC(markers []Marker) (ret []Marker) {
+	for _, m := range markers {
+		if !isICC(m) {
+			ret = append(ret, m)
+		}
+	}
+	return
+}
+
+func isEXIF(m Marker) bool {
+	return m.Marker == MarkerAPP1 && bytes.HasPrefix(m.Data, exifPrefix)
+}
+
+func isXMP(m Marker) bool {
+	return m.Marker == MarkerAPP1 && bytes.HasPrefix(m.Data, xmpPrefix)
+}
+
+// filterMarkers returns the markers to be written under the given policy.
+// If orientation is nonzero, the orientation tag of any EXIF marker is
+// rewritten to match it.
+func filterMarkers(markers []Marker, policy MetadataPolicy, orientation int) (ret []Marker) {
+	for _, m := range markers {
+		switch {
+		case isICC(m):
+			if policy == StripMetadata {
+				continue
+			}
+		case isEXIF(m):
+			if policy != KeepMetadata {
+				continue
+			}
+			if orientation != 0 {
+				m.Data = setExifOrientation(m.Data, orientation)
+			}
+		case isXMP(m), m.Marker == MarkerCOM:
+			if policy != KeepMetadata {
+				continue
+			}
+		default:
+			// JFIF headers are written by libjpeg, and other markers (such
+			// as Adobe APP14) may not apply to the re-encoded image.
+			continue
+		}
+		ret = append(ret, m)
+	}
+	return
+}
+
+// findExifOrientation returns the byte order of the EXIF marker payload data
+// and the offset of its orientation tag value, or a nil byte order if none is
+// found.
+func findExifOrientation(data []byte) (binary.ByteOrder, int) {
+	if !bytes.HasPrefix(data, exifPrefix) {
+		return nil, 0
+	}
+	tiff := data[len(exifPrefix):]
+	if len(tiff) < 8 {
+		return nil, 0
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, 0
+	}
+	if order.Uint16(tiff[2:]) != 42 {
+		return nil, 0
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return nil, 0
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + 12*i
+		if entry+12 > len(tiff) {
+			return nil, 0
+		}
+		if order.Uint16(tiff[entry:]) != exifOrientationTag {
+			continue
+		}
+		// Type SHORT (3), count 1; the value is stored inline.
+		if order.Uint16(tiff[entry+2:]) != 3 || order.Uint32(tiff[entry+4:]) != 1 {
+			return nil, 0
+		}
+		return order, len(exifPrefix) + entry + 8
+	}
+	return nil, 0
+}
+
+// setExifOrientation returns a copy of the EXIF marker payload data with the
+// orientation tag set to orientation. If there is no orientation tag, data is
+// returned unchanged.
+func setExifOrientation(data []byte, orientation int) []byte {
+	order, offset := findExifOrientation(data)
+	if order == nil {
+		return data
+	}
+	ret := make([]byte, len(data))
+	copy(ret, data)
+	order.PutUint16(ret[offset:], uint16(orientation))
+	return ret
+}
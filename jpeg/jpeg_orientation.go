@@ -0,0 +1,93 @@
+package jpeg
+
+// EXIF orientation tag values. Each name describes the transformation needed
+// to display the stored image correctly.
+const (
+	OrientationNormal     = 1 // No transformation
+	OrientationFlipH      = 2 // Mirror horizontally
+	OrientationRotate180  = 3 // Rotate 180 degrees
+	OrientationFlipV      = 4 // Mirror vertically
+	OrientationTranspose  = 5 // Mirror across the top-left/bottom-right diagonal
+	OrientationRotate90   = 6 // Rotate 90 degrees clockwise
+	OrientationTransverse = 7 // Mirror across the top-right/bottom-left diagonal
+	OrientationRotate270  = 8 // Rotate 90 degrees counterclockwise
+)
+
+const exifOrientationTag = 0x0112
+
+// parseExifOrientation extracts the orientation tag from the payload of an
+// EXIF APP1 marker. It returns 0 if the tag is absent or the data is invalid.
+func parseExifOrientation(data []byte) int {
+	order, offset := findExifOrientation(data)
+	if order == nil {
+		return 0
+	}
+	orientation := int(order.Uint16(data[offset:]))
+	if orientation < OrientationNormal || orientation > OrientationRotate270 {
+		return 0
+	}
+	return orientation
+}
+
+// orientPlane copies a width x height plane from src to dst, transforming it
+// as described by orientation.
+func orientPlane(dst []byte, dstStride int, src []byte, srcStride int, width, height int, orientation int) {
+	for y := 0; y < height; y++ {
+		var start, step int
+		switch orientation {
+		case OrientationFlipH:
+			start, step = y*dstStride+width-1, -1
+		case OrientationRotate180:
+			start, step = (height-1-y)*dstStride+width-1, -1
+		case OrientationFlipV:
+			start, step = (height-1-y)*dstStride, 1
+		case OrientationTranspose:
+			start, step = y, dstStride
+		case OrientationRotate90:
+			start, step = height-1-y, dstStride
+		case OrientationTransverse:
+			start, step = (width-1)*dstStride+height-1-y, -dstStride
+		case OrientationRotate270:
+			start, step = (width-1)*dstStride+y, -dstStride
+		default:
+			start, step = y*dstStride, 1
+		}
+		row := src[y*srcStride : y*srcStride+width]
+		for x, pixel := range row {
+			dst[start+x*step] = pixel
+		}
+	}
+}
+
+// ApplyOrientation returns a copy of the image rotated and/or flipped as
+// specified by its Orientation, so that it can be displayed without further
+// transformation. Images which need no transformation are returned as is.
+// Transposing orientations swap the dimensions and, for YUV422 and YUV440,
+// the chroma subsampling mode.
+func (i *YUVImage) ApplyOrientation() *YUVImage {
+	if i.Orientation <= OrientationNormal || i.Orientation > OrientationRotate270 {
+		return i
+	}
+	width, height, format := i.Width, i.Height, i.Format
+	if i.Orientation >= OrientationTranspose {
+		width, height = height, width
+		switch format {
+		case YUV422:
+			format = YUV440
+		case YUV440:
+			format = YUV422
+		}
+	}
+	dst := NewYUVImage(width, height, format)
+	for plane := 0; plane < 3; plane++ {
+		if i.Data[plane] == nil {
+			continue
+		}
+		orientPlane(dst.Data[plane], dst.Stride[plane], i.Data[plane], i.Stride[plane],
+			i.PlaneWidth(plane), i.PlaneHeight(plane), i.Orientation)
+	}
+	dst.ReplicateEdges()
+	dst.Orientation = OrientationNormal
+	dst.Markers = i.Markers
+	return dst
+}
@@ -21,6 +21,7 @@ void sourceInit(struct jpeg_decompress_struct*);
 void sourceSkip(struct jpeg_decompress_struct*, long);
 boolean sourceFill(struct jpeg_decompress_struct*);
 void sourceTerm(struct jpeg_decompress_struct*);
+void progressMonitor(j_common_ptr);
 
 static int DCT_v_scaled_size(j_decompress_ptr dinfo, int component) {
 #if JPEG_LIB_VERSION >= 70
@@ -34,20 +35,35 @@ static int DCT_v_scaled_size(j_decompress_ptr dinfo, int component) {
 import "C"
 
 import (
+	"context"
 	"fmt"
+	"image"
+	"image/color"
 	"io"
+	"runtime"
+	"runtime/cgo"
 	"unsafe"
 )
 
 const readBufferSize = 16384
 
+// sourceState holds the Go values used by a sourceManager. The sourceManager
+// lives in C memory, which must not hold Go pointers, so it only keeps a
+// cgo.Handle to its sourceState.
+type sourceState struct {
+	ctx context.Context
+	src io.Reader
+}
+
 type sourceManager struct {
 	magic       uint32
 	pub         C.struct_jpeg_source_mgr
 	buffer      [readBufferSize]byte
-	src         io.Reader
+	progress    C.struct_jpeg_progress_mgr
+	state       cgo.Handle // *sourceState
 	startOfFile bool
 	currentSize int
+	maxScans    int
 }
 
 func getSourceManager(dinfo *C.struct_jpeg_decompress_struct) (ret *sourceManager) {
@@ -70,14 +86,18 @@ func sourceInit(dinfo *C.struct_jpeg_decompress_struct) {
 //export sourceFill
 func sourceFill(dinfo *C.struct_jpeg_decompress_struct) C.boolean {
 	mgr := getSourceManager(dinfo)
-	bytes, err := mgr.src.Read(mgr.buffer[:])
+	state := mgr.state.Value().(*sourceState)
+	if err := state.ctx.Err(); err != nil {
+		panic(err)
+	}
+	bytes, err := state.src.Read(mgr.buffer[:])
 	mgr.pub.bytes_in_buffer = C.size_t(bytes)
 	mgr.currentSize = bytes
 	mgr.pub.next_input_byte = (*C.JOCTET)(&mgr.buffer[0])
 	if err == io.EOF {
 		if bytes == 0 {
 			if mgr.startOfFile {
-				panic("input is empty")
+				panic(ErrEmptyInput)
 			}
 			// EOF and need more data. Fill in a fake EOI to get a partial image.
 			mgr.buffer[0] = 0xff
@@ -85,7 +105,7 @@ func sourceFill(dinfo *C.struct_jpeg_decompress_struct) C.boolean {
 			mgr.pub.bytes_in_buffer = 2
 		}
 	} else if err != nil {
-		panic(err)
+		panic(&ReadError{err})
 	}
 	mgr.startOfFile = false
 
@@ -107,18 +127,27 @@ func sourceSkip(dinfo *C.struct_jpeg_decompress_struct, bytes C.long) {
 	}
 }
 
+//export progressMonitor
+func progressMonitor(cinfo C.j_common_ptr) {
+	dinfo := (*C.struct_jpeg_decompress_struct)(unsafe.Pointer(cinfo))
+	mgr := getSourceManager(dinfo)
+	if mgr.maxScans > 0 && int(dinfo.input_scan_number) > mgr.maxScans {
+		panic(ErrTooManyScans)
+	}
+}
+
 //export sourceTerm
 func sourceTerm(dinfo *C.struct_jpeg_decompress_struct) {
 	// do nothing
 }
 
-func makeSourceManager(src io.Reader, dinfo *C.struct_jpeg_decompress_struct) (ret *sourceManager) {
-	ret = (*sourceManager)(C.malloc(C.size_t(unsafe.Sizeof(sourceManager{}))))
+func makeSourceManager(ctx context.Context, src io.Reader, dinfo *C.struct_jpeg_decompress_struct) (ret *sourceManager) {
+	ret = (*sourceManager)(C.calloc(1, C.size_t(unsafe.Sizeof(sourceManager{}))))
 	if ret == nil {
 		panic("Failed to allocate sourceManager")
 	}
 	ret.magic = magic
-	ret.src = src
+	ret.state = cgo.NewHandle(&sourceState{ctx: ctx, src: src})
 	ret.pub.init_source = (*[0]byte)(C.sourceInit)
 	ret.pub.fill_input_buffer = (*[0]byte)(C.sourceFill)
 	ret.pub.skip_input_data = (*[0]byte)(C.sourceSkip)
@@ -126,6 +155,8 @@ func makeSourceManager(src io.Reader, dinfo *C.struct_jpeg_decompress_struct) (r
 	ret.pub.term_source = (*[0]byte)(C.sourceTerm)
 	ret.pub.bytes_in_buffer = 0
 	ret.pub.next_input_byte = nil
+	ret.maxScans = 0
+	ret.progress.progress_monitor = (*[0]byte)(C.progressMonitor)
 	dinfo.src = &ret.pub
 	return
 }
@@ -136,34 +167,79 @@ func makeSourceManager(src io.Reader, dinfo *C.struct_jpeg_decompress_struct) (r
 type DecompressionParameters struct {
 	TargetWidth  int  // Desired output width
 	TargetHeight int  // Desired output height
+	Oriented     bool // TargetWidth and TargetHeight refer to the image as displayed per its EXIF orientation
 	FastDCT      bool // Use a faster, less accurate DCT (note: do not use for Quality > 90)
+	SaveMarkers  bool // Save APPn and COM markers in YUVImage.Markers
+
+	// Limits protecting against decompression bombs. Zero means no limit.
+	MaxSourcePixels int64 // Fail with ErrSourceTooLarge if the source image has more pixels than this
+	MaxScans        int   // Fail with ErrTooManyScans if the source image has more scans than this
+	MaxMemory       int64 // Limit libjpeg's internal memory use (max_memory_to_use), in bytes
 }
 
-// ReadJPEG reads a JPEG file and returns a planar YUV image.
-func ReadJPEG(src io.Reader, params DecompressionParameters) (img *YUVImage, err error) {
-	defer func() {
-		if r := recover(); r != nil {
-			img = nil
-			var ok bool
-			err, ok = r.(error)
-			if !ok {
-				err = fmt.Errorf("JPEG error: %v", r)
+// readMarkers copies the markers saved by libjpeg.
+func readMarkers(dinfo *C.struct_jpeg_decompress_struct) (ret []Marker) {
+	for m := dinfo.marker_list; m != nil; m = m.next {
+		ret = append(ret, Marker{
+			Marker: int(m.marker),
+			Data:   C.GoBytes(unsafe.Pointer(m.data), C.int(m.data_length)),
+		})
+	}
+	return
+}
+
+// readOrientation looks for an EXIF orientation tag in the given markers.
+func readOrientation(markers []Marker) int {
+	for _, m := range markers {
+		if !isEXIF(m) {
+			continue
+		}
+		if orientation := parseExifOrientation(m.Data); orientation != 0 {
+			return orientation
+		}
+	}
+	return 0
+}
+
+// convertRow converts a packed RGB or CMYK scanline to YCbCr, into row y of
+// the YUV444 image img. Adobe applications write CMYK (and YCCK) data
+// inverted, and they are the only ones that matter, so inverted should be set
+// if there was an Adobe marker.
+func convertRow(img *YUVImage, y int, row []byte, components int, inverted bool) {
+	yRow := img.Data[Y][y*img.Stride[Y]:]
+	uRow := img.Data[U][y*img.Stride[U]:]
+	vRow := img.Data[V][y*img.Stride[V]:]
+	for x := 0; x < img.Width; x++ {
+		var r, g, b uint8
+		if components == 3 {
+			r, g, b = row[3*x], row[3*x+1], row[3*x+2]
+		} else {
+			cyan, magenta, yellow, black := row[4*x], row[4*x+1], row[4*x+2], row[4*x+3]
+			if !inverted {
+				cyan, magenta, yellow, black = 255-cyan, 255-magenta, 255-yellow, 255-black
 			}
+			// The values now hold the amount of each ink *not* applied
+			r = uint8((uint32(cyan)*uint32(black) + 127) / 255)
+			g = uint8((uint32(magenta)*uint32(black) + 127) / 255)
+			b = uint8((uint32(yellow)*uint32(black) + 127) / 255)
 		}
-	}()
+		yRow[x], uRow[x], vRow[x] = color.RGBToYCbCr(r, g, b)
+	}
+}
 
+// newDecompress allocates a decompression object reading from src, with error
+// handling set up to panic. Reading panics with ctx.Err() once ctx is done. The
+// returned function frees the object.
+func newDecompress(ctx context.Context, src io.Reader) (*C.struct_jpeg_decompress_struct, func()) {
 	dinfo := (*C.struct_jpeg_decompress_struct)(C.malloc(C.size_t(unsafe.Sizeof(C.struct_jpeg_decompress_struct{}))))
 	if dinfo == nil {
 		panic("Failed to allocate dinfo")
 	}
-	defer C.free(unsafe.Pointer(dinfo))
 	dinfo.err = (*C.struct_jpeg_error_mgr)(C.malloc(C.size_t(unsafe.Sizeof(C.struct_jpeg_error_mgr{}))))
 	if dinfo.err == nil {
+		C.free(unsafe.Pointer(dinfo))
 		panic("Failed to allocate dinfo.err")
 	}
-	defer C.free(unsafe.Pointer(dinfo.err))
-
-	img = new(YUVImage)
 
 	// Setup error handling
 	C.jpeg_std_error(dinfo.err)
@@ -171,19 +247,215 @@ func ReadJPEG(src io.Reader, params DecompressionParameters) (img *YUVImage, err
 
 	// Initialize decompression
 	C.c_jpeg_create_decompress(dinfo)
-	defer C.jpeg_destroy_decompress(dinfo)
 
-	srcManager := makeSourceManager(src, dinfo)
-	defer C.free(unsafe.Pointer(srcManager))
+	srcManager := makeSourceManager(ctx, src, dinfo)
+
+	return dinfo, func() {
+		srcManager.state.Delete()
+		C.free(unsafe.Pointer(srcManager))
+		C.jpeg_destroy_decompress(dinfo)
+		C.free(unsafe.Pointer(dinfo.err))
+		C.free(unsafe.Pointer(dinfo))
+	}
+}
+
+// ComponentInfo describes one color component of a JPEG image.
+type ComponentInfo struct {
+	ID          int `json:"id"`
+	HSampFactor int `json:"h_samp_factor"`
+	VSampFactor int `json:"v_samp_factor"`
+}
+
+// Info describes a JPEG image, as read from its header by ReadHeader.
+type Info struct {
+	Width       int             `json:"width"`
+	Height      int             `json:"height"`
+	Colorspace  string          `json:"colorspace"`            // Grayscale, YCbCr, RGB, CMYK, YCCK or Unknown
+	Subsampling string          `json:"subsampling,omitempty"` // 4:4:4, 4:2:2, 4:4:0 or 4:2:0 for YCbCr images
+	Components  []ComponentInfo `json:"components"`
+	Progressive bool            `json:"progressive"`
+	Orientation int             `json:"orientation"` // EXIF orientation (1-8), or 0 if unknown
+}
+
+var colorspaceNames = map[C.J_COLOR_SPACE]string{
+	C.JCS_GRAYSCALE: "Grayscale",
+	C.JCS_YCbCr:     "YCbCr",
+	C.JCS_RGB:       "RGB",
+	C.JCS_CMYK:      "CMYK",
+	C.JCS_YCCK:      "YCCK",
+}
 
+// ReadHeader reads only the header of a JPEG file and describes the image,
+// without decoding any pixel data.
+func ReadHeader(src io.Reader) (info *Info, err error) {
+	defer func() {
+		if err != nil {
+			info = nil
+		}
+	}()
+	defer recoverError(&err)
+
+	dinfo, destroy := newDecompress(context.Background(), src)
+	defer destroy()
+
+	C.jpeg_save_markers(dinfo, C.JPEG_APP0+1, 0xffff)
 	C.jpeg_read_header(dinfo, C.TRUE)
 
+	info = &Info{
+		Width:       int(dinfo.image_width),
+		Height:      int(dinfo.image_height),
+		Colorspace:  "Unknown",
+		Progressive: dinfo.progressive_mode != C.FALSE,
+		Orientation: readOrientation(readMarkers(dinfo)),
+	}
+	if name, ok := colorspaceNames[dinfo.jpeg_color_space]; ok {
+		info.Colorspace = name
+	}
+	compInfo := (*[C.MAX_COMPONENTS]C.jpeg_component_info)(unsafe.Pointer(dinfo.comp_info))
+	for i := 0; i < int(dinfo.num_components); i++ {
+		info.Components = append(info.Components, ComponentInfo{
+			ID:          int(compInfo[i].component_id),
+			HSampFactor: int(compInfo[i].h_samp_factor),
+			VSampFactor: int(compInfo[i].v_samp_factor),
+		})
+	}
+	if dinfo.jpeg_color_space == C.JCS_YCbCr && len(info.Components) == 3 {
+		y, cb, cr := info.Components[Y], info.Components[U], info.Components[V]
+		if cb.HSampFactor == cr.HSampFactor && cb.VSampFactor == cr.VSampFactor {
+			switch [2]int{y.HSampFactor / cb.HSampFactor, y.VSampFactor / cb.VSampFactor} {
+			case [2]int{1, 1}:
+				info.Subsampling = "4:4:4"
+			case [2]int{2, 1}:
+				info.Subsampling = "4:2:2"
+			case [2]int{1, 2}:
+				info.Subsampling = "4:4:0"
+			case [2]int{2, 2}:
+				info.Subsampling = "4:2:0"
+			}
+		}
+	}
+
+	return
+}
+
+// DecodeConfig returns the color model and dimensions of a JPEG image, like
+// image/jpeg.DecodeConfig, using ReadHeader.
+func DecodeConfig(src io.Reader) (image.Config, error) {
+	info, err := ReadHeader(src)
+	if err != nil {
+		return image.Config{}, err
+	}
+	var model color.Model
+	switch info.Colorspace {
+	case "Grayscale":
+		model = color.GrayModel
+	case "RGB":
+		model = color.RGBAModel
+	case "CMYK", "YCCK":
+		model = color.CMYKModel
+	default:
+		model = color.YCbCrModel
+	}
+	return image.Config{ColorModel: model, Width: info.Width, Height: info.Height}, nil
+}
+
+// Number of rows decoded at a time from RGB and CMYK images
+const convertedRows = 16
+
+// Decoder decodes a JPEG image a band of rows at a time, so that the whole
+// image never needs to be held in memory. Use ReadJPEG to decode an image in
+// one go.
+type Decoder struct {
+	ctx       context.Context
+	dinfo     *C.struct_jpeg_decompress_struct
+	destroy   func()
+	img       YUVImage       // Output image properties (no Data)
+	converted bool           // Whether libjpeg decodes to packed RGB or CMYK
+	rowBuf    unsafe.Pointer // Scanline buffer for converted images
+	iMCURows  int            // Rows decoded at a time
+	band      *YUVImage      // Buffer for ReadRows
+	err       error
+}
+
+// ReadJPEG reads a JPEG file and returns a planar YUV image. Errors from src
+// are returned wrapped in a *ReadError, and libjpeg failures as a
+// *CorruptError.
+func ReadJPEG(src io.Reader, params DecompressionParameters) (img *YUVImage, err error) {
+	return ReadJPEGContext(context.Background(), src, params)
+}
+
+// ReadJPEGContext is like ReadJPEG, but stops decoding and returns ctx.Err()
+// once ctx is done.
+func ReadJPEGContext(ctx context.Context, src io.Reader, params DecompressionParameters) (img *YUVImage, err error) {
+	d, err := NewDecoder(ctx, src, params)
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+	return d.ReadImage()
+}
+
+// NewDecoder reads the header of the JPEG file at src and prepares to decode
+// it with ReadRows or ReadImage. Decoding stops with ctx.Err() once ctx is
+// done. The Decoder must be closed after use.
+func NewDecoder(ctx context.Context, src io.Reader, params DecompressionParameters) (d *Decoder, err error) {
+	d = &Decoder{ctx: ctx}
+	defer func() {
+		if err != nil {
+			d.Close()
+			d = nil
+		}
+	}()
+	defer recoverError(&err)
+
+	d.dinfo, d.destroy = newDecompress(ctx, src)
+	dinfo := d.dinfo
+	img := &d.img
+
+	// Install limits
+	if params.MaxMemory > 0 {
+		dinfo.mem.max_memory_to_use = C.long(params.MaxMemory)
+	}
+	if params.MaxScans > 0 {
+		srcManager := getSourceManager(dinfo)
+		srcManager.maxScans = params.MaxScans
+		dinfo.progress = &srcManager.progress
+	}
+
+	// Keep APP1 markers so we can find the EXIF orientation, and everything
+	// else if requested
+	if params.SaveMarkers {
+		C.jpeg_save_markers(dinfo, C.JPEG_COM, 0xffff)
+		for i := 0; i < 16; i++ {
+			C.jpeg_save_markers(dinfo, C.int(C.JPEG_APP0+i), 0xffff)
+		}
+	} else {
+		C.jpeg_save_markers(dinfo, C.JPEG_APP0+1, 0xffff)
+	}
+
+	C.jpeg_read_header(dinfo, C.TRUE)
+
+	if params.MaxSourcePixels > 0 &&
+		int64(dinfo.image_width)*int64(dinfo.image_height) > params.MaxSourcePixels {
+		panic(fmt.Errorf("%w (%dx%d)", ErrSourceTooLarge, dinfo.image_width, dinfo.image_height))
+	}
+
+	markers := readMarkers(dinfo)
+	img.Orientation = readOrientation(markers)
+	if params.SaveMarkers {
+		img.Markers = markers
+	}
+
 	// Configure pre-scaling and request calculation of component info
 	if params.TargetWidth > 0 && params.TargetHeight > 0 {
+		targetWidth, targetHeight := params.TargetWidth, params.TargetHeight
+		if params.Oriented && img.Orientation >= OrientationTranspose {
+			targetWidth, targetHeight = targetHeight, targetWidth
+		}
 		var scaleFactor int
 		for scaleFactor = 1; scaleFactor <= 8; scaleFactor++ {
-			if ((scaleFactor*int(dinfo.image_width)+7)/8) >= params.TargetWidth &&
-				((scaleFactor*int(dinfo.image_height)+7)/8) >= params.TargetHeight {
+			if ((scaleFactor*int(dinfo.image_width)+7)/8) >= targetWidth &&
+				((scaleFactor*int(dinfo.image_height)+7)/8) >= targetHeight {
 				break
 			}
 		}
@@ -199,21 +471,47 @@ func ReadJPEG(src io.Reader, params DecompressionParameters) (img *YUVImage, err
 	} else {
 		dinfo.dct_method = C.JDCT_ISLOW
 	}
+
+	// RGB and CMYK images can't be read as raw YCbCr data. Have libjpeg
+	// decode them to packed RGB or CMYK and convert that ourselves.
+	switch dinfo.jpeg_color_space {
+	case C.JCS_RGB, C.JCS_CMYK, C.JCS_YCCK:
+		if dinfo.jpeg_color_space == C.JCS_RGB {
+			dinfo.out_color_space = C.JCS_RGB
+		} else {
+			dinfo.out_color_space = C.JCS_CMYK
+		}
+		C.jpeg_start_decompress(dinfo)
+		img.Width = int(dinfo.output_width)
+		img.Height = int(dinfo.output_height)
+		img.Format = YUV444
+		// The source's ICC profile describes its RGB or CMYK colors, not
+		// the converted YCbCr ones, so it must not be written out again
+		img.Markers = withoutICC(img.Markers)
+		d.converted = true
+		d.iMCURows = convertedRows
+		d.rowBuf = C.malloc(C.size_t(img.Width * int(dinfo.output_components)))
+		if d.rowBuf == nil {
+			panic("Failed to allocate row buffer")
+		}
+		return
+	}
+
 	C.jpeg_calc_output_dimensions(dinfo)
 
 	// Figure out what color format we're dealing with after scaling
 	compInfo := (*[3]C.jpeg_component_info)(unsafe.Pointer(dinfo.comp_info))
-	colorVDiv := 1
 	switch dinfo.num_components {
 	case 1:
 		if dinfo.jpeg_color_space != C.JCS_GRAYSCALE {
-			panic("Unsupported colorspace")
+			panic(ErrUnsupportedColorspace)
 		}
 		img.Format = Grayscale
 	case 3:
-		// No support for RGB and CMYK (both rare)
+		// Only YCbCr is read as raw data here; other colorspaces go
+		// through the conversion path above
 		if dinfo.jpeg_color_space != C.JCS_YCbCr {
-			panic("Unsupported colorspace")
+			panic(ErrUnsupportedColorspace)
 		}
 		dwY := compInfo[Y].downsampled_width
 		dhY := compInfo[Y].downsampled_height
@@ -221,7 +519,7 @@ func ReadJPEG(src io.Reader, params DecompressionParameters) (img *YUVImage, err
 		dhC := compInfo[U].downsampled_height
 		//fmt.Printf("%d %d %d %d\n", dwY, dhY, dwC, dhC)
 		if dwC != compInfo[V].downsampled_width || dhC != compInfo[V].downsampled_height {
-			panic("Unsupported color subsampling (Cb and Cr differ)")
+			panic(fmt.Errorf("%w (Cb and Cr differ)", ErrUnsupportedSubsampling))
 		}
 		// Since the decisions about which DCT size and subsampling mode
 		// to use, if any, are complex, instead just check the calculated
@@ -231,24 +529,22 @@ func ReadJPEG(src io.Reader, params DecompressionParameters) (img *YUVImage, err
 				img.Format = YUV444
 			} else if (dhY+1)/2 == dhC {
 				img.Format = YUV440
-				colorVDiv = 2
 			} else {
-				panic("Unsupported color subsampling (vertical is not 1 or 2)")
+				panic(fmt.Errorf("%w (vertical is not 1 or 2)", ErrUnsupportedSubsampling))
 			}
 		} else if (dwY+1)/2 == dwC {
 			if dhY == dhC {
 				img.Format = YUV422
 			} else if (dhY+1)/2 == dhC {
 				img.Format = YUV420
-				colorVDiv = 2
 			} else {
-				panic("Unsupported color subsampling (vertical is not 1 or 2)")
+				panic(fmt.Errorf("%w (vertical is not 1 or 2)", ErrUnsupportedSubsampling))
 			}
 		} else {
-			panic("Unsupported color subsampling (horizontal is not 1 or 2)")
+			panic(fmt.Errorf("%w (horizontal is not 1 or 2)", ErrUnsupportedSubsampling))
 		}
 	default:
-		panic("Unsupported number of components")
+		panic(fmt.Errorf("%w (%d components)", ErrUnsupportedColorspace, dinfo.num_components))
 	}
 
 	img.Width = int(compInfo[Y].downsampled_width)
@@ -260,23 +556,66 @@ func ReadJPEG(src io.Reader, params DecompressionParameters) (img *YUVImage, err
 	// planar->packed->planar conversions.
 	dinfo.raw_data_out = C.TRUE
 
-	// Allocate image planes
+	// Start decompression
+	C.jpeg_start_decompress(dinfo)
+
 	for i := 0; i < int(dinfo.num_components); i++ {
-		/*fmt.Printf("%d: %dx%d (DCT %dx%d, %dx%d blocks sf %dx%d)\n", i,
-		  compInfo[i].downsampled_width, compInfo[i].downsampled_height,
-		  compInfo[i].DCT_scaled_size, compInfo[i].DCT_scaled_size,
-		  compInfo[i].width_in_blocks, compInfo[i].height_in_blocks,
-		  compInfo[i].h_samp_factor, compInfo[i].v_samp_factor)*/
-		// When downsampling, odd modes like 14x14 may be used. Pad to AlignSize
-		// (16) and then add an extra AlignSize padding, to cover overflow from
-		// any such modes.
-		img.Stride[i] = pad(int(compInfo[i].downsampled_width), AlignSize) + AlignSize
-		height := pad(int(compInfo[i].downsampled_height), AlignSize) + AlignSize
-		img.Data[i] = make([]byte, img.Stride[i]*height)
+		compRows := int(C.DCT_v_scaled_size(dinfo, C.int(i)) * compInfo[i].v_samp_factor)
+		if compRows > d.iMCURows {
+			d.iMCURows = compRows
+		}
 	}
+	//fmt.Printf("iMCU_rows: %d\n", d.iMCURows)
 
-	// Start decompression
-	C.jpeg_start_decompress(dinfo)
+	return
+}
+
+// Header returns the dimensions, format, orientation and saved markers of the
+// decoded image, without any pixel data.
+func (d *Decoder) Header() *YUVImage {
+	img := d.img
+	return &img
+}
+
+// SourceSize returns the dimensions of the image as stored, before any
+// prescaling.
+func (d *Decoder) SourceSize() (width, height int) {
+	return int(d.dinfo.image_width), int(d.dinfo.image_height)
+}
+
+// Prescale returns the factor by which libjpeg scales the image while decoding
+// it, as a fraction.
+func (d *Decoder) Prescale() (num, denom int) {
+	return int(d.dinfo.scale_num), int(d.dinfo.scale_denom)
+}
+
+// decodeRows decodes the next band of rows into the top of img, which must have
+// the same format and width as the decoded image and room for d.iMCURows rows,
+// plus padding as allocated by NewYUVImage. It returns the number of rows of
+// the image that were decoded.
+func (d *Decoder) decodeRows(img *YUVImage) int {
+	dinfo := d.dinfo
+	start := int(dinfo.output_scanline)
+
+	if d.converted {
+		width := int(dinfo.output_width)
+		components := int(dinfo.output_components)
+		rowPtr := C.JSAMPROW(d.rowBuf)
+		row := (*[1 << 30]byte)(d.rowBuf)[: width*components : width*components]
+		inverted := dinfo.saw_Adobe_marker != C.FALSE
+		for y := 0; y < d.iMCURows && int(dinfo.output_scanline) < d.img.Height; y++ {
+			if err := d.ctx.Err(); err != nil {
+				panic(err)
+			}
+			C.jpeg_read_scanlines(dinfo, C.JSAMPARRAY(unsafe.Pointer(&rowPtr)), 1)
+			convertRow(img, y, row, components, inverted)
+		}
+		return int(dinfo.output_scanline) - start
+	}
+
+	if err := d.ctx.Err(); err != nil {
+		panic(err)
+	}
 
 	// Allocate JSAMPIMAGE to hold pointers to one iMCU worth of image data
 	// this is a safe overestimate; we use the return value from
@@ -287,35 +626,99 @@ func ReadJPEG(src io.Reader, params DecompressionParameters) (img *YUVImage, err
 		C.JSAMPARRAY(unsafe.Pointer(&yuvPtrInt[1][0])),
 		C.JSAMPARRAY(unsafe.Pointer(&yuvPtrInt[2][0])),
 	}
+	// Everything the pointers passed to C point to must be pinned
+	var pinner runtime.Pinner
+	defer pinner.Unpin()
+	for i := 0; i < int(dinfo.num_components); i++ {
+		pinner.Pin(&yuvPtrInt[i][0])
+		pinner.Pin(&img.Data[i][0])
+	}
 
-	// Decode the image.
-	var row C.JDIMENSION
-
-	var iMCURows int
+	// First fill in the pointers into the plane data buffers
 	for i := 0; i < int(dinfo.num_components); i++ {
-		compRows := int(C.DCT_v_scaled_size(dinfo, C.int(i)) * compInfo[i].v_samp_factor)
-		if compRows > iMCURows {
-			iMCURows = compRows
+		for j := 0; j < d.iMCURows; j++ {
+			yuvPtrInt[i][j] = C.JSAMPROW(unsafe.Pointer(&img.Data[i][img.Stride[i]*j]))
 		}
 	}
-	//fmt.Printf("iMCU_rows: %d (div: %d)\n", iMCURows, colorVDiv)
-	for row = 0; row < dinfo.output_height; {
-		// First fill in the pointers into the plane data buffers
-		for i := 0; i < int(dinfo.num_components); i++ {
-			for j := 0; j < iMCURows; j++ {
-				compRow := (int(row) + j)
-				if i > 0 {
-					compRow = (int(row)/colorVDiv + j)
-				}
-				yuvPtrInt[i][j] = C.JSAMPROW(unsafe.Pointer(&img.Data[i][img.Stride[i]*compRow]))
-			}
+	// Get the data
+	rows := int(C.jpeg_read_raw_data(dinfo, C.JSAMPIMAGE(unsafe.Pointer(&yuvPtr[0])), C.JDIMENSION(2*d.iMCURows)))
+	if start+rows > d.img.Height {
+		rows = d.img.Height - start
+	}
+	return rows
+}
+
+// finish completes decompression once all rows have been decoded.
+func (d *Decoder) finish() {
+	if int(d.dinfo.output_scanline) >= d.img.Height {
+		C.jpeg_finish_decompress(d.dinfo)
+	}
+}
+
+// ReadRows decodes the next band of rows of the image, returning it as a
+// YUVImage whose Height is the number of rows in the band. For vertically
+// subsampled formats, every band but the last has an even number of rows.
+// The returned image is only valid until the next call to ReadRows. At the end
+// of the image, ReadRows returns io.EOF.
+func (d *Decoder) ReadRows() (band *YUVImage, err error) {
+	if d.err != nil {
+		return nil, d.err
+	}
+	if int(d.dinfo.output_scanline) >= d.img.Height {
+		return nil, io.EOF
+	}
+	defer func() {
+		if err != nil {
+			band = nil
+			d.err = err
 		}
-		// Get the data
-		row += C.jpeg_read_raw_data(dinfo, C.JSAMPIMAGE(unsafe.Pointer(&yuvPtr[0])), C.JDIMENSION(2*iMCURows))
+	}()
+	defer recoverError(&err)
+
+	if d.band == nil {
+		d.band = NewYUVImage(d.img.Width, d.iMCURows, d.img.Format)
 	}
+	band = new(YUVImage)
+	*band = *d.band
+	band.Height = d.decodeRows(d.band)
+	d.finish()
+	return
+}
 
-	// Clean up
-	C.jpeg_finish_decompress(dinfo)
+// ReadImage decodes the whole image at once, instead of using ReadRows.
+func (d *Decoder) ReadImage() (img *YUVImage, err error) {
+	if d.err != nil {
+		return nil, d.err
+	}
+	defer func() {
+		if err != nil {
+			img = nil
+			d.err = err
+		}
+	}()
+	defer recoverError(&err)
 
+	img = NewYUVImage(d.img.Width, d.img.Height, d.img.Format)
+	img.Orientation = d.img.Orientation
+	img.Markers = d.img.Markers
+	for row := int(d.dinfo.output_scanline); row < img.Height; row = int(d.dinfo.output_scanline) {
+		d.decodeRows(img.Crop(0, row, img.Width, img.Height-row))
+	}
+	if d.converted {
+		img.ReplicateEdges()
+	}
+	d.finish()
 	return
 }
+
+// Close frees the resources used by the Decoder.
+func (d *Decoder) Close() {
+	if d.rowBuf != nil {
+		C.free(d.rowBuf)
+		d.rowBuf = nil
+	}
+	if d.destroy != nil {
+		d.destroy()
+		d.destroy = nil
+	}
+}
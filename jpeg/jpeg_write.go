@@ -28,8 +28,11 @@ void destinationTerm(struct jpeg_compress_struct*);
 import "C"
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"runtime"
+	"runtime/cgo"
 	"unsafe"
 )
 
@@ -39,7 +42,7 @@ type destinationManager struct {
 	magic  uint32
 	pub    C.struct_jpeg_destination_mgr
 	buffer [writeBufferSize]byte
-	dest   io.Writer
+	dest   cgo.Handle // io.Writer, since C memory must not hold Go pointers
 }
 
 func getDestinationManager(cinfo *C.struct_jpeg_compress_struct) (ret *destinationManager) {
@@ -59,11 +62,12 @@ func destinationInit(cinfo *C.struct_jpeg_compress_struct) {
 }
 
 func flushBuffer(mgr *destinationManager, inBuffer int) {
+	dest := mgr.dest.Value().(io.Writer)
 	wrote := 0
 	for wrote != inBuffer {
-		bytes, err := mgr.dest.Write(mgr.buffer[wrote:inBuffer])
+		bytes, err := dest.Write(mgr.buffer[wrote:inBuffer])
 		if err != nil {
-			panic(err)
+			panic(&WriteError{err})
 		}
 		wrote += int(bytes)
 	}
@@ -88,12 +92,12 @@ func destinationTerm(cinfo *C.struct_jpeg_compress_struct) {
 }
 
 func makeDestinationManager(dest io.Writer, cinfo *C.struct_jpeg_compress_struct) (ret *destinationManager) {
-	ret = (*destinationManager)(C.malloc(C.size_t(unsafe.Sizeof(destinationManager{}))))
+	ret = (*destinationManager)(C.calloc(1, C.size_t(unsafe.Sizeof(destinationManager{}))))
 	if ret == nil {
 		panic("Failed to allocate destinationManager")
 	}
 	ret.magic = magic
-	ret.dest = dest
+	ret.dest = cgo.NewHandle(dest)
 	ret.pub.init_destination = (*[0]byte)(C.destinationInit)
 	ret.pub.empty_output_buffer = (*[0]byte)(C.destinationEmpty)
 	ret.pub.term_destination = (*[0]byte)(C.destinationTerm)
@@ -105,39 +109,58 @@ func makeDestinationManager(dest io.Writer, cinfo *C.struct_jpeg_compress_struct
 
 // CompressionParameters specifies which settings to use during Compression.
 type CompressionParameters struct {
-	Quality  int  // Desired JPEG quality, 0-99
-	Optimize bool // Whether to optimize the Huffman tables (slower)
-	FastDCT  bool // Use a faster, less accurate DCT (note: do not use for Quality > 90)
+	Quality     int            // Desired JPEG quality, 0-99
+	Optimize    bool           // Whether to optimize the Huffman tables (slower)
+	Progressive bool           // Whether to write a progressive JPEG
+	FastDCT     bool           // Use a faster, less accurate DCT (note: do not use for Quality > 90)
+	Metadata    MetadataPolicy // Which of img.Markers to write
 }
 
-// WriteJPEG writes a YUVImage as a JPEG into dest.
+// Encoder encodes a JPEG image a band of rows at a time, so that the whole
+// image never needs to be held in memory. Use WriteJPEG to encode an image in
+// one go.
+type Encoder struct {
+	ctx     context.Context
+	cinfo   *C.struct_jpeg_compress_struct
+	destroy func()
+	img     YUVImage  // Image properties (no Data)
+	band    *YUVImage // Buffer for one iMCU row
+	rows    int       // Rows in band
+	row     int       // Rows encoded so far
+	err     error
+}
+
+// WriteJPEG writes a YUVImage as a JPEG into dest. Markers saved in the image
+// are written according to params.Metadata; if the image has a known
+// Orientation, the orientation tag of an EXIF marker is updated to match.
+// Errors from dest are returned wrapped in a *WriteError.
 func WriteJPEG(img *YUVImage, dest io.Writer, params CompressionParameters) (err error) {
-	defer func() {
-		if r := recover(); r != nil {
-			img = nil
-			var ok bool
-			err, ok = r.(error)
-			if !ok {
-				err = fmt.Errorf("JPEG error: %v", r)
-			}
-		}
-	}()
+	return WriteJPEGContext(context.Background(), img, dest, params)
+}
+
+// WriteJPEGContext is like WriteJPEG, but stops encoding and returns ctx.Err()
+// once ctx is done. Some data may already have been written to dest.
+func WriteJPEGContext(ctx context.Context, img *YUVImage, dest io.Writer, params CompressionParameters) (err error) {
+	e, err := NewEncoder(ctx, dest, img, params)
+	if err != nil {
+		return err
+	}
+	defer e.Close()
+	return e.WriteImage(img)
+}
 
+// newCompress allocates a compression object writing to dest, with error
+// handling set up to panic. The returned function frees the object.
+func newCompress(dest io.Writer) (*C.struct_jpeg_compress_struct, func()) {
 	cinfo := (*C.struct_jpeg_compress_struct)(C.malloc(C.size_t(unsafe.Sizeof(C.struct_jpeg_compress_struct{}))))
 	if cinfo == nil {
 		panic("Failed to allocate cinfo")
 	}
-	defer C.free(unsafe.Pointer(cinfo))
 	cinfo.err = (*C.struct_jpeg_error_mgr)(C.malloc(C.size_t(unsafe.Sizeof(C.struct_jpeg_error_mgr{}))))
 	if cinfo.err == nil {
+		C.free(unsafe.Pointer(cinfo))
 		panic("Failed to allocate cinfo.err")
 	}
-	defer C.free(unsafe.Pointer(cinfo.err))
-
-	// No subsampling suport for now
-	if img.Format != YUV444 && img.Format != Grayscale {
-		panic("Unsupported colorspace")
-	}
 
 	// Setup error handling
 	C.jpeg_std_error(cinfo.err)
@@ -145,10 +168,50 @@ func WriteJPEG(img *YUVImage, dest io.Writer, params CompressionParameters) (err
 
 	// Initialize compression object
 	C.c_jpeg_create_compress(cinfo)
-	defer C.jpeg_destroy_compress(cinfo)
 
 	destManager := makeDestinationManager(dest, cinfo)
-	defer C.free(unsafe.Pointer(destManager))
+
+	return cinfo, func() {
+		destManager.dest.Delete()
+		C.free(unsafe.Pointer(destManager))
+		C.jpeg_destroy_compress(cinfo)
+		C.free(unsafe.Pointer(cinfo.err))
+		C.free(unsafe.Pointer(cinfo))
+	}
+}
+
+// NewEncoder starts writing a JPEG image into dest, with the dimensions,
+// format, orientation and markers of img (its pixel data is not used). The
+// pixel data is then passed to WriteRows or WriteImage. Encoding stops with
+// ctx.Err() once ctx is done. The Encoder must be closed after use.
+func NewEncoder(ctx context.Context, dest io.Writer, img *YUVImage, params CompressionParameters) (e *Encoder, err error) {
+	e = &Encoder{ctx: ctx}
+	defer func() {
+		if err != nil {
+			e.Close()
+			e = nil
+		}
+	}()
+	defer recoverError(&err)
+
+	// Luma sampling factors for each format (chroma is always 1x1)
+	var hSamp, vSamp C.int
+	switch img.Format {
+	case Grayscale, YUV444:
+		hSamp, vSamp = 1, 1
+	case YUV422:
+		hSamp, vSamp = 2, 1
+	case YUV440:
+		hSamp, vSamp = 1, 2
+	case YUV420:
+		hSamp, vSamp = 2, 2
+	default:
+		panic(ErrUnsupportedColorspace)
+	}
+
+	e.img = YUVImage{Width: img.Width, Height: img.Height, Format: img.Format}
+	e.cinfo, e.destroy = newCompress(dest)
+	cinfo := e.cinfo
 
 	// Set up compression parameters
 	cinfo.image_width = C.JDIMENSION(img.Width)
@@ -175,11 +238,19 @@ func WriteJPEG(img *YUVImage, dest io.Writer, params CompressionParameters) (err
 	}
 	compInfo := (*[3]C.jpeg_component_info)(unsafe.Pointer(cinfo.comp_info))
 
-	for i := 0; i < int(cinfo.input_components); i++ {
+	compInfo[Y].h_samp_factor = hSamp
+	compInfo[Y].v_samp_factor = vSamp
+	for i := 1; i < int(cinfo.input_components); i++ {
 		compInfo[i].h_samp_factor = 1
 		compInfo[i].v_samp_factor = 1
 	}
 
+	// Progressive mode uses the standard libjpeg scan script. This must be
+	// set up after the colorspace and sampling factors.
+	if params.Progressive {
+		C.jpeg_simple_progression(cinfo)
+	}
+
 	// libjpeg raw data in is in planar format, which avoids unnecessary
 	// planar->packed->planar conversions.
 	cinfo.raw_data_in = C.TRUE
@@ -187,6 +258,32 @@ func WriteJPEG(img *YUVImage, dest io.Writer, params CompressionParameters) (err
 	// Start compression
 	C.jpeg_start_compress(cinfo, C.TRUE)
 
+	// Write metadata markers, which must come right after the JFIF header
+	for _, m := range filterMarkers(img.Markers, params.Metadata, img.Orientation) {
+		if len(m.Data) == 0 {
+			continue
+		}
+		C.jpeg_write_marker(cinfo, C.int(m.Marker), (*C.JOCTET)(unsafe.Pointer(&m.Data[0])), C.uint(len(m.Data)))
+	}
+
+	return
+}
+
+// iMCURows returns the number of rows encoded at a time.
+func (e *Encoder) iMCURows() int {
+	return int(C.DCTSIZE * e.cinfo.max_v_samp_factor)
+}
+
+// encodeRows encodes one iMCU row, starting at the given row of img.
+// Each call consumes DCTSIZE rows for each vertical sampling unit, so
+// subsampled chroma planes advance at a fraction of the luma rate.
+func (e *Encoder) encodeRows(img *YUVImage, row int) {
+	if err := e.ctx.Err(); err != nil {
+		panic(err)
+	}
+	cinfo := e.cinfo
+	compInfo := (*[3]C.jpeg_component_info)(unsafe.Pointer(cinfo.comp_info))
+
 	// Allocate JSAMPIMAGE to hold pointers to one iMCU worth of image data
 	// this is a safe overestimate; we use the return value from
 	// jpeg_read_raw_data to figure out what is the actual iMCU row count.
@@ -196,23 +293,107 @@ func WriteJPEG(img *YUVImage, dest io.Writer, params CompressionParameters) (err
 		C.JSAMPARRAY(unsafe.Pointer(&yuvPtrInt[1][0])),
 		C.JSAMPARRAY(unsafe.Pointer(&yuvPtrInt[2][0])),
 	}
+	// Everything the pointers passed to C point to must be pinned
+	var pinner runtime.Pinner
+	defer pinner.Unpin()
+	for i := 0; i < int(cinfo.num_components); i++ {
+		pinner.Pin(&yuvPtrInt[i][0])
+		pinner.Pin(&img.Data[i][0])
+	}
+
+	// First fill in the pointers into the plane data buffers
+	for i := 0; i < int(cinfo.num_components); i++ {
+		for j := 0; j < int(C.DCTSIZE*compInfo[i].v_samp_factor); j++ {
+			compRow := row*int(compInfo[i].v_samp_factor)/int(cinfo.max_v_samp_factor) + j
+			yuvPtrInt[i][j] = C.JSAMPROW(unsafe.Pointer(&img.Data[i][img.Stride[i]*compRow]))
+		}
+	}
+	// Get the data
+	C.jpeg_write_raw_data(cinfo, C.JSAMPIMAGE(unsafe.Pointer(&yuvPtr[0])), C.JDIMENSION(e.iMCURows()))
+}
 
-	// Encode the image.
-	var row C.JDIMENSION
-	for row = 0; row < cinfo.image_height; {
-		// First fill in the pointers into the plane data buffers
-		for i := 0; i < int(cinfo.num_components); i++ {
-			for j := 0; j < int(C.DCTSIZE*compInfo[i].v_samp_factor); j++ {
-				compRow := (int(row) + j)
-				yuvPtrInt[i][j] = C.JSAMPROW(unsafe.Pointer(&img.Data[i][img.Stride[i]*compRow]))
-			}
+// WriteImage encodes the whole of img at once, instead of using WriteRows.
+// img must be padded to a multiple of the iMCU size, as images allocated by
+// NewYUVImage are.
+func (e *Encoder) WriteImage(img *YUVImage) (err error) {
+	if e.err != nil {
+		return e.err
+	}
+	defer func() {
+		if err != nil {
+			e.err = err
 		}
-		// Get the data
-		row += C.jpeg_write_raw_data(cinfo, C.JSAMPIMAGE(unsafe.Pointer(&yuvPtr[0])), C.JDIMENSION(C.DCTSIZE*compInfo[0].v_samp_factor))
+	}()
+	defer recoverError(&err)
+
+	for ; e.row < e.img.Height; e.row += e.iMCURows() {
+		e.encodeRows(img, e.row)
 	}
 
 	// Clean up
-	C.jpeg_finish_compress(cinfo)
+	C.jpeg_finish_compress(e.cinfo)
+
+	return
+}
+
+// WriteRows encodes the next band of rows of the image, given as a YUVImage
+// whose Height is the number of rows in the band. For vertically subsampled
+// formats, every band but the last must have an even number of rows. Rows are
+// buffered until a whole iMCU row is available; the right and bottom edges of
+// the image are replicated to fill partial iMCUs. The JPEG is finished once the
+// last row of the image has been written.
+func (e *Encoder) WriteRows(band *YUVImage) (err error) {
+	if e.err != nil {
+		return e.err
+	}
+	if band.Width != e.img.Width || band.Format != e.img.Format {
+		return fmt.Errorf("band is %dx%d (format %d), expected width %d (format %d)",
+			band.Width, band.Height, band.Format, e.img.Width, e.img.Format)
+	}
+	if e.row+e.rows+band.Height > e.img.Height {
+		return fmt.Errorf("too many rows (%d > %d)", e.row+e.rows+band.Height, e.img.Height)
+	}
+	defer func() {
+		if err != nil {
+			e.err = err
+		}
+	}()
+	defer recoverError(&err)
+
+	iMCURows := e.iMCURows()
+	if e.band == nil {
+		e.band = NewYUVImage(e.img.Width, iMCURows, e.img.Format)
+	}
+	for y := 0; y < band.Height; {
+		rows := band.Height - y
+		if rows > iMCURows-e.rows {
+			rows = iMCURows - e.rows
+		}
+		e.band.Draw(band.Crop(0, y, band.Width, rows), 0, e.rows)
+		e.rows += rows
+		y += rows
+
+		if e.rows == iMCURows || e.row+e.rows == e.img.Height {
+			filled := *e.band
+			filled.Height = e.rows
+			filled.ReplicateEdges()
+			e.encodeRows(e.band, 0)
+			e.row += e.rows
+			e.rows = 0
+		}
+	}
+
+	if e.row == e.img.Height {
+		C.jpeg_finish_compress(e.cinfo)
+	}
 
 	return
 }
+
+// Close frees the resources used by the Encoder.
+func (e *Encoder) Close() {
+	if e.destroy != nil {
+		e.destroy()
+		e.destroy = nil
+	}
+}
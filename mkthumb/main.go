@@ -5,26 +5,58 @@ import (
 	"fmt"
 	"os"
 
+	"github.com/pixiv/go-thumber/jpeg"
 	"github.com/pixiv/go-thumber/thumbnail"
 )
 
 var params thumbnail.ThumbnailParameters
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "sign" {
+		signMain(os.Args[2:])
+		return
+	}
+
 	flag.IntVar(&params.Width, "w", 128, "target width")
 	flag.IntVar(&params.Height, "h", 128, "target width")
 	flag.BoolVar(&params.ForceAspect, "a", false, "force aspect")
+	flag.BoolVar(&params.Crop, "c", false, "crop to fill the target size")
+	gravity := flag.String("g", "c", "crop gravity (c, n, s, e, w, ne, nw, se, sw)")
+	flag.BoolVar(&params.NoOrient, "no-orient", false, "ignore the EXIF orientation tag")
 	flag.BoolVar(&params.Upscale, "u", false, "also upscale if needed")
 	flag.IntVar(&params.Quality, "q", 95, "JPEG quality")
 	flag.BoolVar(&params.Optimize, "o", false, "optimize JPEG")
+	flag.BoolVar(&params.Progressive, "pr", false, "progressive JPEG")
+	subsampling := flag.String("ss", "444", "chroma subsampling (444, 422, 440, 420)")
+	metadata := flag.Int("m", int(jpeg.KeepICC), "metadata to keep: 0 = none, 1 = ICC profile, 2 = ICC, EXIF, XMP and comments")
 	flag.Float64Var(&params.PrescaleFactor, "p", 1.0, "prescale factor")
 	flag.Parse()
 
-	if flag.NArg() != 2 {
+	usage := func() {
 		fmt.Printf("USAGE: mkthumb [options] input_file output_file\n")
+		fmt.Printf("       mkthumb sign -keys file [-expires duration] path...\n")
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
+	if flag.NArg() != 2 {
+		usage()
+	}
+
+	params.Metadata = jpeg.MetadataPolicy(*metadata)
+	if params.Metadata < jpeg.StripMetadata || params.Metadata > jpeg.KeepMetadata {
+		fmt.Printf("Metadata (-m) must be 0, 1 or 2\n")
+		usage()
+	}
+
+	var err error
+	params.Gravity, err = thumbnail.ParseGravity(*gravity)
+	if err != nil {
+		panic(err)
+	}
+	params.Subsampling, err = thumbnail.ParseSubsampling(*subsampling)
+	if err != nil {
+		panic(err)
+	}
 
 	inputFilename := flag.Arg(0)
 	outputFilename := flag.Arg(1)
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/pixiv/go-thumber/urlsign"
+)
+
+// signMain implements "mkthumb sign", which prints signed thumberd paths.
+func signMain(args []string) {
+	flags := flag.NewFlagSet("sign", flag.ExitOnError)
+	keyFile := flags.String("keys", "", "file of secret keys, as given to thumberd -sign-keys; the first key is used")
+	expires := flags.Duration("expires", 0, "how long the signed paths are valid for, e.g. 24h (0 for no expiry)")
+	flags.Parse(args)
+
+	if *keyFile == "" || flags.NArg() == 0 {
+		fmt.Printf("USAGE: mkthumb sign -keys file [-expires duration] path...\n")
+		fmt.Printf("  where path has the form /w=128,h=128/upstream-host.com/some-image.jpg\n")
+		flags.PrintDefaults()
+		os.Exit(1)
+	}
+
+	keys, err := urlsign.ReadKeys(*keyFile)
+	if err != nil {
+		panic(err)
+	}
+	var expiry time.Time
+	if *expires != 0 {
+		expiry = time.Now().Add(*expires)
+	}
+	for _, path := range flags.Args() {
+		signed, err := urlsign.Sign(keys[0], path, expiry)
+		if err != nil {
+			panic(err)
+		}
+		fmt.Println(signed)
+	}
+}
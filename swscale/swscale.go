@@ -7,12 +7,30 @@ package swscale
 
 #include <stdlib.h>
 #include <stdio.h>
+#include <stddef.h>
 #include <libswscale/swscale.h>
+
+// scale_slice calls sws_scale with the destination planes moved up by
+// dstOffset rows, since libswscale writes each row of output at its position
+// in the whole image but we only keep a window of rows.
+static int scale_slice(struct SwsContext *sws, uint8_t *src[], int srcStride[],
+		int srcSliceY, int srcSliceH, uint8_t *dst[], int dstStride[], int dstOffset[]) {
+	uint8_t *shifted[4];
+	int i;
+	for (i = 0; i < 4; i++) {
+		shifted[i] = dst[i] ? dst[i] - (ptrdiff_t)dstOffset[i] * dstStride[i] : NULL;
+	}
+	return sws_scale(sws, (const uint8_t *const *)src, srcStride, srcSliceY, srcSliceH,
+		shifted, dstStride);
+}
 */
 import "C"
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"runtime"
 	"unsafe"
 
 	"github.com/pixiv/go-thumber/jpeg"
@@ -38,24 +56,119 @@ const (
 
 // ScaleOptions contains scaling parameters
 type ScaleOptions struct {
-	DstWidth, DstHeight int    // Target dimensions
-	Filter              Filter // Filter type
+	DstWidth, DstHeight int              // Target dimensions
+	DstFormat           jpeg.PixelFormat // Target format for color images (YUV444 if left as Grayscale)
+	Filter              Filter           // Filter type
 }
 
+// Number of source rows passed to libswscale at a time by ScaleContext (must
+// be even, for vertically subsampled chroma), so that it can stop between
+// slices when its context is done. A new Scaler's window also starts with
+// room for the output of a couple of slices.
+const sliceHeight = 64
+
+// libswscale outputs a row once all the source rows covered by its vertical
+// filter are available (and all remaining rows at the end of the image). This
+// is a generous bound on how far the output may lag behind the input, in
+// source rows, and on the number of extra rows that may be output because of
+// rounding.
+const filterMargin = 32
+
 func pad(a int, b int) int {
 	return (a + (b - 1)) & (^(b - 1))
 }
 
+// Scaler scales an image a band of rows at a time, so that neither the source
+// nor the scaled image need to be held in memory as a whole. Use Scale to scale
+// an image in one go.
+type Scaler struct {
+	sws        *C.struct_SwsContext
+	src        jpeg.YUVImage // Source image properties (no Data)
+	components int
+	padFactor  int
+	srcRow     int           // Source rows consumed so far
+	dst        jpeg.YUVImage // Window of destination rows, starting at row base
+	dstVDiv    int           // Vertical chroma subsampling of dst
+	windowRows int           // Rows allocated in dst
+	base       int           // Destination row at the top of the window
+	dstRow     int           // Destination rows output by libswscale so far
+	returned   int           // Destination rows returned by ScaleRows so far
+}
+
 // Scale a YUVImage and return the new YUVImage
 func Scale(src *jpeg.YUVImage, opts ScaleOptions) (*jpeg.YUVImage, error) {
+	return ScaleContext(context.Background(), src, opts)
+}
+
+// ScaleContext is like Scale, but returns ctx.Err() if ctx is done before
+// scaling finishes.
+func ScaleContext(ctx context.Context, src *jpeg.YUVImage, opts ScaleOptions) (*jpeg.YUVImage, error) {
+	// The window holds the whole destination image, so it never moves
+	s, err := newScaler(src, opts, opts.DstHeight)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	// Feed the source to libswscale in slices, so that we can give up early
+	// if the context is done.
+	for y := 0; y < src.Height; y += sliceHeight {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		sliceH := sliceHeight
+		if y+sliceH > src.Height {
+			sliceH = src.Height - y
+		}
+		if err := s.scale(src.Crop(0, y, src.Width, sliceH)); err != nil {
+			return nil, err
+		}
+	}
+
+	dst := s.dst
+	dst.Orientation = src.Orientation
+	dst.Markers = src.Markers
+
+	// Replicate the last column and row of pixels as padding, which is typical
+	// behavior prior to JPEG compression
+	dst.ReplicateEdges()
+
+	return &dst, nil
+}
+
+// NewScaler prepares to scale an image with the dimensions and format of src
+// (its pixel data is not used), which is then passed to ScaleRows. The Scaler
+// must be closed after use.
+func NewScaler(src *jpeg.YUVImage, opts ScaleOptions) (*Scaler, error) {
+	// Start with room for a couple of bands' worth of output
+	rows := (2*sliceHeight+filterMargin)*opts.DstHeight/src.Height + filterMargin
+	if rows > opts.DstHeight {
+		rows = opts.DstHeight
+	}
+	return newScaler(src, opts, rows)
+}
+
+func newScaler(src *jpeg.YUVImage, opts ScaleOptions, windowRows int) (*Scaler, error) {
 	// Figure out what format we're dealing with
 	var srcFmt, dstFmt int32
 	var flags C.int
 	flags = C.SWS_FULL_CHR_H_INT | C.int(opts.Filter) | C.SWS_ACCURATE_RND
-	components := 3
-	var dst jpeg.YUVImage
-	dstFmt = C.AV_PIX_FMT_YUV444P
-	dst.Format = jpeg.YUV444
+	s := &Scaler{components: 3, dstVDiv: 1}
+	s.src = jpeg.YUVImage{Width: src.Width, Height: src.Height, Format: src.Format}
+	switch opts.DstFormat {
+	case jpeg.YUV422:
+		dstFmt = C.AV_PIX_FMT_YUV422P
+	case jpeg.YUV440:
+		dstFmt = C.AV_PIX_FMT_YUV440P
+		s.dstVDiv = 2
+	case jpeg.YUV420:
+		dstFmt = C.AV_PIX_FMT_YUV420P
+		s.dstVDiv = 2
+	default:
+		opts.DstFormat = jpeg.YUV444
+		dstFmt = C.AV_PIX_FMT_YUV444P
+	}
+	s.dst.Format = opts.DstFormat
 	switch src.Format {
 	case jpeg.YUV444:
 		srcFmt = C.AV_PIX_FMT_YUV444P
@@ -69,53 +182,97 @@ func Scale(src *jpeg.YUVImage, opts ScaleOptions) (*jpeg.YUVImage, error) {
 	case jpeg.Grayscale:
 		srcFmt = C.AV_PIX_FMT_GRAY8
 		dstFmt = C.AV_PIX_FMT_GRAY8
-		components = 1
-		dst.Format = jpeg.Grayscale
+		s.components = 1
+		s.dst.Format = jpeg.Grayscale
+		s.dstVDiv = 1
 	}
 
 	// swscale can't handle images smaller than this; pad them
 	paddedDstWidth := opts.DstWidth
 	paddedSrcWidth := src.Width
-	padFactor := 1
+	s.padFactor = 1
 	for paddedDstWidth < 8 || paddedSrcWidth < 4 {
 		paddedDstWidth *= 2
 		paddedSrcWidth *= 2
-		padFactor *= 2
+		s.padFactor *= 2
 	}
 
 	// Get the SWS context
-	sws := C.sws_getContext(C.int(paddedSrcWidth), C.int(src.Height), srcFmt,
+	s.sws = C.sws_getContext(C.int(paddedSrcWidth), C.int(src.Height), srcFmt,
 		C.int(paddedDstWidth), C.int(opts.DstHeight), dstFmt,
 		flags, nil, nil, nil)
 
-	if sws == nil {
+	if s.sws == nil {
 		return nil, errors.New("sws_getContext failed")
 	}
 
-	defer C.sws_freeContext(sws)
+	// Allocate the window of destination rows
+	s.dst.Width = opts.DstWidth
+	s.dst.Height = opts.DstHeight
+	s.windowRows = pad(windowRows, jpeg.AlignSize)
+	dstStride := pad(paddedDstWidth, jpeg.AlignSize)
+	for i := 0; i < s.components; i++ {
+		s.dst.Stride[i] = dstStride
+		s.dst.Data[i] = make([]byte, dstStride*s.windowRows)
+	}
 
+	return s, nil
+}
+
+// reserve makes sure that the window has room for the destination rows that
+// libswscale may output when given srcRows more source rows, moving rows that
+// have already been returned out of the window or growing it if necessary.
+func (s *Scaler) reserve(srcRows int) {
+	need := (srcRows+filterMargin)*s.dst.Height/s.src.Height + filterMargin
+	if need > s.dst.Height-s.dstRow {
+		need = s.dst.Height - s.dstRow
+	}
+	if s.base+s.windowRows-s.dstRow >= need {
+		return
+	}
+
+	rows := s.windowRows
+	if s.dstRow-s.returned+need > rows {
+		rows = pad(s.dstRow-s.returned+need, jpeg.AlignSize)
+	}
+	for i := 0; i < s.components; i++ {
+		vdiv := 1
+		if i > 0 {
+			vdiv = s.dstVDiv
+		}
+		stride := s.dst.Stride[i]
+		from := (s.returned - s.base) / vdiv
+		to := (s.dstRow+vdiv-1)/vdiv - s.base/vdiv
+		data := s.dst.Data[i]
+		if rows != s.windowRows {
+			data = make([]byte, stride*rows)
+		}
+		copy(data, s.dst.Data[i][from*stride:to*stride])
+		s.dst.Data[i] = data
+	}
+	s.windowRows = rows
+	s.base = s.returned
+}
+
+// scale passes the next band of source rows to libswscale.
+func (s *Scaler) scale(src *jpeg.YUVImage) error {
 	// We only need 3 planes, but libswscale is stupid and checks the alignment
 	// of all 4 pointers... better give it a dummy one.
 	var srcYUVPtr [4](*uint8)
 	var dstYUVPtr [4](*uint8)
 	var srcStrides [4](C.int)
 	var dstStrides [4](C.int)
+	var dstOffsets [4](C.int)
+	// The pointer arrays are passed to C, so the planes they point to must
+	// be pinned.
+	var pinner runtime.Pinner
+	defer pinner.Unpin()
 
-	dst.Width = opts.DstWidth
-	dst.Height = opts.DstHeight
-	dstStride := pad(paddedDstWidth, jpeg.AlignSize)
-	dstFinalPaddedWidth := pad(opts.DstWidth, jpeg.AlignSize)
-	dstPaddedHeight := pad(opts.DstHeight, jpeg.AlignSize)
-	// Allocate image planes and pointers
-	for i := 0; i < components; i++ {
-		dst.Stride[i] = dstStride
-		dst.Data[i] = make([]byte, dstStride*dstPaddedHeight)
-		dstYUVPtr[i] = (*uint8)(unsafe.Pointer(&dst.Data[i][0]))
-		dstStrides[i] = C.int(dstStride)
+	for i := 0; i < s.components; i++ {
 		// apply horizontal padding if image is too small
-		if padFactor > 1 {
+		if s.padFactor > 1 {
 			planeWidth := src.PlaneWidth(i)
-			paddedWidth := planeWidth * padFactor
+			paddedWidth := planeWidth * s.padFactor
 			planeHeight := src.PlaneHeight(i)
 			paddedStride := pad(paddedWidth, jpeg.AlignSize)
 			newData := make([]uint8, paddedStride*planeHeight)
@@ -130,27 +287,69 @@ func Scale(src *jpeg.YUVImage, opts ScaleOptions) (*jpeg.YUVImage, error) {
 			srcYUVPtr[i] = &newData[0]
 		} else {
 			srcStrides[i] = C.int(src.Stride[i])
-			srcYUVPtr[i] = (*uint8)(unsafe.Pointer(&src.Data[i][0]))
+			srcYUVPtr[i] = &src.Data[i][0]
 		}
+		pinner.Pin(srcYUVPtr[i])
 	}
 
-	C.sws_scale(sws, (**C.uint8_t)(unsafe.Pointer(&srcYUVPtr[0])), &srcStrides[0], 0, C.int(src.Height),
-		(**C.uint8_t)(unsafe.Pointer(&dstYUVPtr[0])), &dstStrides[0])
-
-	// Replicate the last column and row of pixels as padding, which is typical
-	// behavior prior to JPEG compression
-	for i := 0; i < components; i++ {
-		for y := 0; y < dst.Height; y++ {
-			pixel := dst.Data[i][y*dstStride+dst.Width-1]
-			for x := dst.Width; x < dstFinalPaddedWidth; x++ {
-				dst.Data[i][y*dstStride+x] = pixel
-			}
-		}
-		lastRow := dst.Data[i][dstStride*(dst.Height-1) : dstStride*dst.Height]
-		for y := dst.Height; y < dstPaddedHeight; y++ {
-			copy(dst.Data[i][y*dstStride:], lastRow)
+	s.reserve(src.Height)
+	for i := 0; i < s.components; i++ {
+		dstYUVPtr[i] = (*uint8)(unsafe.Pointer(&s.dst.Data[i][0]))
+		pinner.Pin(dstYUVPtr[i])
+		dstStrides[i] = C.int(s.dst.Stride[i])
+		dstOffsets[i] = C.int(s.base)
+		if i > 0 {
+			dstOffsets[i] /= C.int(s.dstVDiv)
 		}
 	}
 
-	return &dst, nil
+	rows := C.scale_slice(s.sws, (**C.uint8_t)(unsafe.Pointer(&srcYUVPtr[0])), &srcStrides[0], C.int(s.srcRow), C.int(src.Height),
+		(**C.uint8_t)(unsafe.Pointer(&dstYUVPtr[0])), &dstStrides[0], &dstOffsets[0])
+	if rows < 0 {
+		return errors.New("sws_scale failed")
+	}
+	s.srcRow += src.Height
+	s.dstRow += int(rows)
+	if s.dstRow > s.base+s.windowRows {
+		return fmt.Errorf("sws_scale overran the destination window (%d > %d rows)", s.dstRow, s.base+s.windowRows)
+	}
+	return nil
+}
+
+// ScaleRows scales the next band of source rows, given as a YUVImage whose
+// Height is the number of rows in the band. For vertically subsampled formats,
+// every band but the last must have an even number of rows. It returns the
+// band of destination rows that are complete, which may be empty, and is only
+// valid until the next call to ScaleRows. Every band but the last has an even
+// number of rows if the destination is vertically subsampled.
+func (s *Scaler) ScaleRows(src *jpeg.YUVImage) (*jpeg.YUVImage, error) {
+	if src.Width != s.src.Width || src.Format != s.src.Format {
+		return nil, fmt.Errorf("band is %dx%d (format %d), expected width %d (format %d)",
+			src.Width, src.Height, src.Format, s.src.Width, s.src.Format)
+	}
+	if s.srcRow+src.Height > s.src.Height {
+		return nil, fmt.Errorf("too many rows (%d > %d)", s.srcRow+src.Height, s.src.Height)
+	}
+	if err := s.scale(src); err != nil {
+		return nil, err
+	}
+	if s.srcRow == s.src.Height && s.dstRow != s.dst.Height {
+		return nil, fmt.Errorf("sws_scale output %d of %d rows", s.dstRow, s.dst.Height)
+	}
+
+	end := s.dstRow
+	if end < s.dst.Height {
+		end -= end % s.dstVDiv
+	}
+	band := s.dst.Crop(0, s.returned-s.base, s.dst.Width, end-s.returned)
+	s.returned = end
+	return band, nil
+}
+
+// Close frees the resources used by the Scaler.
+func (s *Scaler) Close() {
+	if s.sws != nil {
+		C.sws_freeContext(s.sws)
+		s.sws = nil
+	}
 }
@@ -0,0 +1,57 @@
+package swscale
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pixiv/go-thumber/jpeg"
+)
+
+// cancelAfterContext is canceled by the n-th call to its Err method, so that
+// a test can cancel it at a known point partway through an operation.
+type cancelAfterContext struct {
+	context.Context
+	cancel context.CancelFunc
+	n      int
+	calls  int
+}
+
+func newCancelAfterContext(n int) *cancelAfterContext {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &cancelAfterContext{Context: ctx, cancel: cancel, n: n}
+}
+
+func (c *cancelAfterContext) Err() error {
+	c.calls++
+	if c.calls == c.n {
+		c.cancel()
+	}
+	return c.Context.Err()
+}
+
+func TestScaleContextCanceledPartway(t *testing.T) {
+	src := jpeg.NewYUVImage(4000, 3000, jpeg.YUV420)
+	src.Fill(0x80, 0x40, 0xc0)
+	opts := ScaleOptions{DstWidth: 800, DstHeight: 600, DstFormat: jpeg.YUV420, Filter: Lanczos}
+
+	ctx := newCancelAfterContext(5)
+	defer ctx.cancel()
+	if _, err := ScaleContext(ctx, src, opts); err != context.Canceled {
+		t.Fatalf("Got %v, expected %v", err, context.Canceled)
+	}
+	// The context is checked once per slice, so scaling stopped right
+	// after it was canceled, long before the end of the image
+	if slices := (src.Height + sliceHeight - 1) / sliceHeight; ctx.calls != 5 || slices <= 5 {
+		t.Errorf("Context checked %d times before giving up (image has %d slices), expected 5", ctx.calls, slices)
+	}
+
+	ctx = newCancelAfterContext(0)
+	defer ctx.cancel()
+	dst, err := ScaleContext(ctx, src, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dst.Width != 800 || dst.Height != 600 {
+		t.Errorf("Scaled to %dx%d, expected 800x600", dst.Width, dst.Height)
+	}
+}
@@ -0,0 +1,119 @@
+//go:build ignore
+// +build ignore
+
+// This program generates the RGB and CMYK test images. Run it from this
+// directory with:
+//
+//	go run generate.go
+//
+// Each image is 64x64 with red, green, blue and gray quadrants (top left, top
+// right, bottom left, bottom right).
+package main
+
+/*
+#cgo LDFLAGS: -ljpeg
+
+#include <stdlib.h>
+#include <stdio.h>
+#include <jpeglib.h>
+
+static void write_jpeg(const char *filename, unsigned char *pixels, int width, int height,
+		int components, J_COLOR_SPACE in_space, J_COLOR_SPACE jpeg_space, boolean adobe) {
+	struct jpeg_compress_struct cinfo;
+	struct jpeg_error_mgr jerr;
+	FILE *f = fopen(filename, "wb");
+	int y;
+
+	cinfo.err = jpeg_std_error(&jerr);
+	jpeg_create_compress(&cinfo);
+	jpeg_stdio_dest(&cinfo, f);
+	cinfo.image_width = width;
+	cinfo.image_height = height;
+	cinfo.input_components = components;
+	cinfo.in_color_space = in_space;
+	jpeg_set_defaults(&cinfo);
+	jpeg_set_colorspace(&cinfo, jpeg_space);
+	jpeg_set_quality(&cinfo, 95, TRUE);
+	cinfo.write_Adobe_marker = adobe;
+	jpeg_start_compress(&cinfo, TRUE);
+	for (y = 0; y < height; y++) {
+		JSAMPROW row = pixels + y * width * components;
+		jpeg_write_scanlines(&cinfo, &row, 1);
+	}
+	jpeg_finish_compress(&cinfo);
+	jpeg_destroy_compress(&cinfo);
+	fclose(f);
+}
+*/
+import "C"
+
+import (
+	"image/color"
+	"unsafe"
+)
+
+const size = 64
+
+var quadrants = [4]color.RGBA{
+	{255, 0, 0, 255},
+	{0, 255, 0, 255},
+	{0, 0, 255, 255},
+	{128, 128, 128, 255},
+}
+
+func pixel(x, y int) color.RGBA {
+	q := 0
+	if x >= size/2 {
+		q++
+	}
+	if y >= size/2 {
+		q += 2
+	}
+	return quadrants[q]
+}
+
+// cmyk converts an RGB color to CMYK ink values. If inverted, the values are
+// stored inverted, as Adobe applications do.
+func cmyk(c color.RGBA, inverted bool) []byte {
+	cc, mm, yy, kk := color.RGBToCMYK(c.R, c.G, c.B)
+	ret := []byte{cc, mm, yy, kk}
+	if inverted {
+		for i := range ret {
+			ret[i] = 255 - ret[i]
+		}
+	}
+	return ret
+}
+
+func write(filename string, components int, inSpace, jpegSpace C.J_COLOR_SPACE, adobe bool, convert func(color.RGBA) []byte) {
+	pixels := make([]byte, 0, size*size*components)
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			pixels = append(pixels, convert(pixel(x, y))...)
+		}
+	}
+	buf := C.CBytes(pixels)
+	defer C.free(buf)
+	name := C.CString(filename)
+	defer C.free(unsafe.Pointer(name))
+	var a C.boolean = C.FALSE
+	if adobe {
+		a = C.TRUE
+	}
+	C.write_jpeg(name, (*C.uchar)(buf), size, size, C.int(components), inSpace, jpegSpace, a)
+}
+
+func main() {
+	write("rgb.jpg", 3, C.JCS_RGB, C.JCS_RGB, true, func(c color.RGBA) []byte {
+		return []byte{c.R, c.G, c.B}
+	})
+	write("cmyk.jpg", 4, C.JCS_CMYK, C.JCS_CMYK, false, func(c color.RGBA) []byte {
+		return cmyk(c, false)
+	})
+	write("cmyk-adobe.jpg", 4, C.JCS_CMYK, C.JCS_CMYK, true, func(c color.RGBA) []byte {
+		return cmyk(c, true)
+	})
+	write("ycck-adobe.jpg", 4, C.JCS_CMYK, C.JCS_YCCK, true, func(c color.RGBA) []byte {
+		return cmyk(c, true)
+	})
+}
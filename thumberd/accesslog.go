@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var access_log = flag.String("access-log", "", "write an access log of thumbnail requests, as JSON lines, to this file (- for standard output)")
+var access_log_sample = flag.Float64("access-log-sample", 1, "fraction of successful requests to write to the access log (failures are always written)")
+
+// accessLog is where access log entries are written, if anywhere.
+var accessLog *accessLogger
+
+// accessLogger writes access log entries to w, one JSON object per line.
+type accessLogger struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// newAccessLogger makes an accessLogger for the -access-log flag.
+func newAccessLogger(dest string) (*accessLogger, error) {
+	var w io.Writer = os.Stdout
+	if dest != "-" {
+		f, err := os.OpenFile(dest, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		w = f
+	}
+	return &accessLogger{enc: json.NewEncoder(w)}, nil
+}
+
+// accessLogEntry describes a thumbnail request. Times are in milliseconds.
+type accessLogEntry struct {
+	Time           time.Time `json:"time"`
+	Client         string    `json:"client"`
+	Method         string    `json:"method"`
+	Path           string    `json:"path"`
+	Params         string    `json:"params,omitempty"`
+	UpstreamHost   string    `json:"upstream_host,omitempty"`
+	UpstreamStatus int       `json:"upstream_status,omitempty"`
+	Status         int       `json:"status"`
+	Error          string    `json:"error,omitempty"` // The http_stats counter of the failure
+	Cached         bool      `json:"cached,omitempty"`
+	SourceWidth    int       `json:"source_width,omitempty"`
+	SourceHeight   int       `json:"source_height,omitempty"`
+	Width          int       `json:"width,omitempty"`
+	Height         int       `json:"height,omitempty"`
+	Bytes          int64     `json:"bytes"`
+	Duration       float64   `json:"duration_ms"`
+	QueueTime      float64   `json:"queue_ms,omitempty"`
+	UpstreamTime   float64   `json:"upstream_ms,omitempty"`
+	DecodeTime     float64   `json:"decode_ms,omitempty"`
+	ScaleTime      float64   `json:"scale_ms,omitempty"`
+	EncodeTime     float64   `json:"encode_ms,omitempty"`
+}
+
+// fail counts a failed request in counter, and records it as the class of
+// error.
+func (e *accessLogEntry) fail(counter *int64) {
+	atomic.AddInt64(counter, 1)
+	for _, class := range errorClasses {
+		if class.counter == counter {
+			e.Error = class.name
+		}
+	}
+}
+
+// describe records how t was made, and whether it came from a cache.
+func (e *accessLogEntry) describe(t *thumb, cached bool) {
+	e.Cached = cached
+	e.SourceWidth, e.SourceHeight = t.stats.SourceWidth, t.stats.SourceHeight
+	e.Width, e.Height = t.stats.Width, t.stats.Height
+	if !cached {
+		e.QueueTime = milliseconds(t.queueTime)
+		e.UpstreamTime = milliseconds(t.upstreamTime)
+		e.DecodeTime = milliseconds(t.stats.DecodeTime)
+		e.ScaleTime = milliseconds(t.stats.ScaleTime)
+		e.EncodeTime = milliseconds(t.stats.EncodeTime)
+	}
+}
+
+func milliseconds(d time.Duration) float64 {
+	return d.Seconds() * 1000
+}
+
+// upstreamHost returns the host of an upstream, or the prefix of the source
+// it is routed to.
+func upstreamHost(upstream string) string {
+	for _, route := range sourceRoutes {
+		if strings.HasPrefix(upstream, route.prefix+"/") {
+			return route.prefix
+		}
+	}
+	u, err := url.Parse(upstreamURL(upstream))
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+// logAccess writes e to accessLog, if enabled, completing it with the
+// response recorded by w and the time since start. Successful requests are
+// sampled as configured with -access-log-sample.
+func logAccess(e *accessLogEntry, w *responseRecorder, r *http.Request, start time.Time) {
+	if accessLog == nil {
+		return
+	}
+	if e.Error == "" && *access_log_sample < 1 && rand.Float64() >= *access_log_sample {
+		return
+	}
+	e.Time = start
+	e.Client = r.RemoteAddr
+	e.Method = r.Method
+	e.Path = r.URL.RequestURI()
+	e.Status = w.status
+	e.Bytes = w.bytes
+	e.Duration = milliseconds(time.Now().Sub(start))
+
+	accessLog.mu.Lock()
+	defer accessLog.mu.Unlock()
+	accessLog.enc.Encode(e)
+}
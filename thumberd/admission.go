@@ -0,0 +1,134 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var errQueueFull = errors.New("too many requests queued")
+var errQueueTimeout = errors.New("timed out waiting in queue")
+
+// admission limits the number of thumbnail jobs that run at once, and
+// optionally the total number of source pixels they decode. Jobs that can't
+// run yet wait in a bounded FIFO queue.
+type admission struct {
+	maxJobs   int           // 0 for no limit
+	maxPixels int64         // 0 for no limit
+	maxQueue  int           // Jobs allowed to wait
+	timeout   time.Duration // How long jobs may wait
+
+	mu     sync.Mutex
+	jobs   int
+	pixels int64
+	queue  *list.List // of *admissionWaiter
+}
+
+type admissionWaiter struct {
+	pixels int64
+	ready  chan struct{} // Closed once admitted
+}
+
+func newAdmission(maxJobs int, maxPixels int64, maxQueue int, timeout time.Duration) *admission {
+	return &admission{
+		maxJobs:   maxJobs,
+		maxPixels: maxPixels,
+		maxQueue:  maxQueue,
+		timeout:   timeout,
+		queue:     list.New(),
+	}
+}
+
+// fits returns whether a job decoding pixels source pixels can run now. A job
+// larger than maxPixels is allowed to run on its own. a.mu must be held.
+func (a *admission) fits(pixels int64) bool {
+	if a.maxJobs > 0 && a.jobs >= a.maxJobs {
+		return false
+	}
+	if a.maxPixels > 0 && a.pixels > 0 && a.pixels+pixels > a.maxPixels {
+		return false
+	}
+	return true
+}
+
+// admit starts a job. a.mu must be held.
+func (a *admission) admit(pixels int64) {
+	a.jobs++
+	a.pixels += pixels
+	atomic.StoreInt64(&http_stats.jobs_running, int64(a.jobs))
+}
+
+// acquire waits until a job decoding pixels source pixels (0 if unknown) can
+// run. It fails with errQueueFull if too many jobs are already waiting,
+// errQueueTimeout if the job waited too long, or ctx.Err(). release must be
+// called once an acquired job is done.
+func (a *admission) acquire(ctx context.Context, pixels int64) error {
+	a.mu.Lock()
+	if a.queue.Len() == 0 && a.fits(pixels) {
+		a.admit(pixels)
+		a.mu.Unlock()
+		return nil
+	}
+	if a.queue.Len() >= a.maxQueue {
+		a.mu.Unlock()
+		return errQueueFull
+	}
+	w := &admissionWaiter{pixels: pixels, ready: make(chan struct{})}
+	elem := a.queue.PushBack(w)
+	atomic.StoreInt64(&http_stats.jobs_queued, int64(a.queue.Len()))
+	a.mu.Unlock()
+
+	timer := time.NewTimer(a.timeout)
+	defer timer.Stop()
+	var err error
+	select {
+	case <-w.ready:
+		return nil
+	case <-timer.C:
+		err = errQueueTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	select {
+	case <-w.ready:
+		// Admitted just now after all
+		return nil
+	default:
+	}
+	a.queue.Remove(elem)
+	// Jobs behind this one may fit now
+	a.wake()
+	return err
+}
+
+// release ends a job started by acquire, and starts waiting jobs that now fit.
+func (a *admission) release(pixels int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.jobs--
+	a.pixels -= pixels
+	atomic.StoreInt64(&http_stats.jobs_running, int64(a.jobs))
+	a.wake()
+}
+
+// wake admits jobs from the front of the queue for as long as they fit. a.mu
+// must be held.
+func (a *admission) wake() {
+	for a.queue.Len() > 0 {
+		front := a.queue.Front()
+		w := front.Value.(*admissionWaiter)
+		if !a.fits(w.pixels) {
+			break
+		}
+		a.queue.Remove(front)
+		a.admit(w.pixels)
+		close(w.ready)
+	}
+	atomic.StoreInt64(&http_stats.jobs_queued, int64(a.queue.Len()))
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// accessTime returns the last access time of a file. Only Linux is supported;
+// elsewhere this is the modification time.
+func accessTime(fi os.FileInfo) time.Time {
+	return fi.ModTime()
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// cacheEntry is a cached thumbnail.
+type cacheEntry struct {
+	key   string
+	thumb *thumb
+}
+
+// cache is an in-memory LRU cache of thumbnails, bounded by the total size of
+// the thumbnails it holds. Entries expire ttl after they were added.
+type cache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	ttl      time.Duration
+	size     int64
+	lru      *list.List // Most recently used at the front
+	entries  map[string]*list.Element
+}
+
+func newCache(maxBytes int64, ttl time.Duration) *cache {
+	return &cache{
+		maxBytes: maxBytes,
+		ttl:      ttl,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+// get returns the thumbnail cached under key.
+func (c *cache) get(key string) (*thumb, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		atomic.AddInt64(&http_stats.cache_miss, 1)
+		return nil, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if c.ttl > 0 && time.Since(entry.thumb.created) > c.ttl {
+		c.remove(elem)
+		atomic.AddInt64(&http_stats.cache_evict, 1)
+		atomic.AddInt64(&http_stats.cache_miss, 1)
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	atomic.AddInt64(&http_stats.cache_hit, 1)
+	return entry.thumb, true
+}
+
+// put adds a thumbnail to the cache, evicting the least recently used entries
+// to make room for it. Thumbnails larger than the whole cache are not added.
+func (c *cache) put(key string, t *thumb) {
+	if int64(len(t.data)) > c.maxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+	for c.size+int64(len(t.data)) > c.maxBytes {
+		c.remove(c.lru.Back())
+		atomic.AddInt64(&http_stats.cache_evict, 1)
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, thumb: t})
+	c.size += int64(len(t.data))
+	atomic.StoreInt64(&http_stats.cache_bytes, c.size)
+}
+
+// remove removes an entry. c.mu must be held.
+func (c *cache) remove(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.size -= int64(len(entry.thumb.data))
+	atomic.StoreInt64(&http_stats.cache_bytes, c.size)
+}
+
+// getCached looks for a thumbnail in the memory cache and then on disk.
+func getCached(key string) (*thumb, bool) {
+	if thumbCache != nil {
+		if t, ok := thumbCache.get(key); ok {
+			return t, true
+		}
+	}
+	if thumbDiskCache != nil {
+		if t, ok := thumbDiskCache.get(key); ok {
+			if thumbCache != nil {
+				thumbCache.put(key, t)
+			}
+			return t, true
+		}
+	}
+	return nil, false
+}
+
+// putCached adds a thumbnail to the enabled caches.
+func putCached(key string, t *thumb) {
+	if thumbCache != nil {
+		thumbCache.put(key, t)
+	}
+	if thumbDiskCache != nil {
+		thumbDiskCache.put(key, t)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+)
+
+// flight is a thumbnail being made for one or more identical requests.
+type flight struct {
+	done    chan struct{} // Closed once thumb and err are set
+	cancel  context.CancelFunc
+	waiters int // Requests waiting for the thumbnail; guarded by flightGroup.mu
+	thumb   *thumb
+	err     error
+}
+
+// flightGroup coalesces identical concurrent requests, so that each thumbnail
+// is only fetched and made once.
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+var flights = flightGroup{flights: make(map[string]*flight)}
+
+// do makes the thumbnail identified by key with fn, unless it is already being
+// made for another request, in which case it waits for that instead. fn runs
+// with its own context, which is canceled once every request waiting for it
+// has gone away (that is, their ctx is done), so one client disconnecting
+// doesn't affect the others. It has the deadline of the first request, if
+// any, so that the work doesn't outlive it for the sake of later requests.
+func (g *flightGroup) do(ctx context.Context, key string, fn func(context.Context) (*thumb, error)) (*thumb, error) {
+	g.mu.Lock()
+	f, ok := g.flights[key]
+	if ok {
+		atomic.AddInt64(&http_stats.coalesced, 1)
+	} else {
+		var fctx context.Context
+		f = &flight{done: make(chan struct{})}
+		if deadline, ok := ctx.Deadline(); ok {
+			fctx, f.cancel = context.WithDeadline(context.Background(), deadline)
+		} else {
+			fctx, f.cancel = context.WithCancel(context.Background())
+		}
+		g.flights[key] = f
+		go func() {
+			t, err := runFlight(fctx, fn)
+			g.mu.Lock()
+			if g.flights[key] == f {
+				delete(g.flights, key)
+			}
+			g.mu.Unlock()
+			f.cancel()
+			f.thumb, f.err = t, err
+			close(f.done)
+		}()
+	}
+	f.waiters++
+	g.mu.Unlock()
+
+	select {
+	case <-f.done:
+		return f.thumb, f.err
+	case <-ctx.Done():
+		g.mu.Lock()
+		f.waiters--
+		if f.waiters == 0 {
+			// Nobody wants this thumbnail any more. Later requests for it
+			// start over.
+			if g.flights[key] == f {
+				delete(g.flights, key)
+			}
+			f.cancel()
+		}
+		g.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// runFlight calls fn, turning a panic into an error. fn doesn't run on a
+// handler goroutine, so net/http isn't there to recover it.
+func runFlight(ctx context.Context, fn func(context.Context) (*thumb, error)) (t *thumb, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("panic making thumbnail: %v\n%s", r, debug.Stack())
+			t, err = nil, fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return fn(ctx)
+}
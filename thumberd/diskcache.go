@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Part of the key of every file, changed whenever the format of the files
+// changes so that files in the old format are ignored (and eventually evicted).
+const diskCacheVersion = "3"
+
+// diskCacheHeader is the first line of each file, as JSON. The thumbnail
+// follows it.
+type diskCacheHeader struct {
+	Modified     time.Time `json:"modified"`
+	ETag         string    `json:"etag"`
+	CacheControl string    `json:"cache_control,omitempty"`
+}
+
+// Prefix of files being written to the disk cache
+const diskCacheTempPrefix = ".tmp-"
+
+// Temporary files older than this were left behind by a crash, and are removed
+const diskCacheTempMaxAge = time.Hour
+
+// The disk cache is evicted down to this fraction of its maximum size, so that
+// eviction doesn't run again right away.
+const diskCacheLowWater = 0.9
+
+// diskCache is a persistent cache of thumbnails in a directory. Each thumbnail
+// is stored in a file named after the hash of its key, in subdirectories named
+// after the first bytes of the hash, with the modification time of the file
+// set to when the thumbnail was made. Files are written atomically by renaming
+// them into place. When the cache grows larger than maxBytes, the least
+// recently accessed files are removed in the background.
+type diskCache struct {
+	dir      string
+	maxBytes int64
+	ttl      time.Duration
+	evict    chan struct{}
+
+	mu   sync.Mutex
+	size int64 // Approximate; recalculated by each eviction pass
+}
+
+func newDiskCache(dir string, maxBytes int64, ttl time.Duration) (*diskCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	c := &diskCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		ttl:      ttl,
+		evict:    make(chan struct{}, 1),
+	}
+	go c.run()
+	// Find out how large the cache is after a restart
+	c.evict <- struct{}{}
+	return c, nil
+}
+
+// path returns the file name for key.
+func (c *diskCache) path(key string) string {
+	sum := sha256.Sum256([]byte(diskCacheVersion + " " + key))
+	name := hex.EncodeToString(sum[:])
+	return filepath.Join(c.dir, name[0:2], name[2:4], name)
+}
+
+// expired returns whether the file of a thumbnail is older than the TTL.
+func (c *diskCache) expired(fi os.FileInfo) bool {
+	return c.ttl > 0 && time.Since(fi.ModTime()) > c.ttl
+}
+
+// get returns the thumbnail cached under key. Expired thumbnails are removed.
+func (c *diskCache) get(key string) (*thumb, bool) {
+	path := c.path(key)
+	data, err := ioutil.ReadFile(path)
+	var header diskCacheHeader
+	i := bytes.IndexByte(data, '\n')
+	if err != nil || i < 0 || json.Unmarshal(data[:i], &header) != nil {
+		atomic.AddInt64(&http_stats.disk_cache_miss, 1)
+		return nil, false
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		atomic.AddInt64(&http_stats.disk_cache_miss, 1)
+		return nil, false
+	}
+	if c.expired(fi) {
+		// Don't leave it taking up space until it is evicted
+		if os.Remove(path) == nil {
+			c.mu.Lock()
+			c.size -= fi.Size()
+			c.mu.Unlock()
+			atomic.AddInt64(&http_stats.disk_cache_bytes, -fi.Size())
+		}
+		atomic.AddInt64(&http_stats.disk_cache_miss, 1)
+		return nil, false
+	}
+	// Record the access explicitly, since the filesystem may not (noatime).
+	// The modification time is when the thumbnail was made.
+	os.Chtimes(path, time.Now(), fi.ModTime())
+	atomic.AddInt64(&http_stats.disk_cache_hit, 1)
+	return &thumb{
+		data:         data[i+1:],
+		created:      fi.ModTime(),
+		modified:     header.Modified,
+		etag:         header.ETag,
+		cacheControl: header.CacheControl,
+	}, true
+}
+
+// put writes a thumbnail to the cache.
+func (c *diskCache) put(key string, t *thumb) {
+	path := c.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		log.Print("disk cache: ", err)
+		return
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), diskCacheTempPrefix)
+	if err != nil {
+		log.Print("disk cache: ", err)
+		return
+	}
+	header, err := json.Marshal(diskCacheHeader{t.modified, t.etag, t.cacheControl})
+	if err == nil {
+		_, err = f.Write(append(header, '\n'))
+	}
+	if err == nil {
+		_, err = f.Write(t.data)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chtimes(f.Name(), time.Now(), t.created)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		log.Print("disk cache: ", err)
+		os.Remove(f.Name())
+		return
+	}
+
+	c.mu.Lock()
+	size := int64(len(header) + 1 + len(t.data))
+	c.size += size
+	full := c.size > c.maxBytes
+	c.mu.Unlock()
+	atomic.AddInt64(&http_stats.disk_cache_bytes, size)
+	if full {
+		select {
+		case c.evict <- struct{}{}:
+		default: // Already pending
+		}
+	}
+}
+
+// run evicts files whenever asked to.
+func (c *diskCache) run() {
+	for range c.evict {
+		c.evictFiles()
+	}
+}
+
+type diskCacheFile struct {
+	path  string
+	size  int64
+	atime time.Time
+}
+
+// evictFiles measures the size of the cache, removes expired files and then
+// the least recently accessed ones until it is below the low water mark.
+func (c *diskCache) evictFiles() {
+	var files []diskCacheFile
+	var size int64
+	filepath.Walk(c.dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return nil
+		}
+		if strings.HasPrefix(fi.Name(), diskCacheTempPrefix) {
+			if time.Since(fi.ModTime()) > diskCacheTempMaxAge {
+				os.Remove(path)
+			}
+			return nil
+		}
+		if c.expired(fi) {
+			os.Remove(path)
+			return nil
+		}
+		files = append(files, diskCacheFile{path, fi.Size(), accessTime(fi)})
+		size += fi.Size()
+		return nil
+	})
+
+	if size > c.maxBytes {
+		sort.Slice(files, func(i, j int) bool { return files[i].atime.Before(files[j].atime) })
+		for _, f := range files {
+			if float64(size) <= float64(c.maxBytes)*diskCacheLowWater {
+				break
+			}
+			if err := os.Remove(f.path); err != nil {
+				continue
+			}
+			size -= f.size
+			atomic.AddInt64(&http_stats.disk_cache_evict, 1)
+		}
+	}
+
+	// Files written during the walk may have been missed; they will be
+	// counted by the next one.
+	c.mu.Lock()
+	c.size = size
+	c.mu.Unlock()
+	atomic.StoreInt64(&http_stats.disk_cache_bytes, size)
+}
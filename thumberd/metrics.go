@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Upper bounds of the buckets of latency histograms, in seconds
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// histogram is a histogram of durations, in latencyBuckets.
+type histogram struct {
+	mu     sync.Mutex
+	counts []uint64 // Per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+func newHistogram() *histogram {
+	return &histogram{counts: make([]uint64, len(latencyBuckets))}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	v := d.Seconds()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if i := sort.SearchFloat64s(latencyBuckets, v); i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.sum += v
+	h.count++
+}
+
+// write writes the samples of h in the Prometheus text format, with labels
+// (such as `phase="decode"`) if not empty.
+func (h *histogram) write(w io.Writer, name, labels string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	bucketLabels, sampleLabels := "", ""
+	if labels != "" {
+		bucketLabels, sampleLabels = labels+",", "{"+labels+"}"
+	}
+	var cumulative uint64
+	for i, le := range latencyBuckets {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{%sle=\"%g\"} %d\n", name, bucketLabels, le, cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", name, bucketLabels, h.count)
+	fmt.Fprintf(w, "%s_sum%s %g\n", name, sampleLabels, h.sum)
+	fmt.Fprintf(w, "%s_count%s %d\n", name, sampleLabels, h.count)
+}
+
+// Phases of making a thumbnail, timed in metrics.phaseDuration
+var phases = []string{"queue", "upstream", "decode", "scale", "encode"}
+
+var metrics = struct {
+	requestDuration *histogram
+	phaseDuration   map[string]*histogram
+	inputBytes      int64
+	outputBytes     int64
+
+	mu        sync.Mutex
+	responses map[int]int64 // By status code
+}{
+	requestDuration: newHistogram(),
+	phaseDuration:   make(map[string]*histogram),
+	responses:       make(map[int]int64),
+}
+
+func init() {
+	for _, phase := range phases {
+		metrics.phaseDuration[phase] = newHistogram()
+	}
+}
+
+// errorClasses are the http_stats counters of failed requests.
+var errorClasses = []struct {
+	name    string
+	counter *int64
+}{
+	{"arg_error", &http_stats.arg_error},
+	{"sign_error", &http_stats.sign_error},
+	{"blocked_upstream", &http_stats.blocked_upstream},
+	{"upstream_error", &http_stats.upstream_error},
+	{"corrupt_error", &http_stats.corrupt_error},
+	{"unsupported_error", &http_stats.unsupported_error},
+	{"limit_error", &http_stats.limit_error},
+	{"thumb_error", &http_stats.thumb_error},
+	{"write_error", &http_stats.write_error},
+	{"canceled", &http_stats.canceled},
+	{"jobs_rejected", &http_stats.jobs_rejected},
+	{"jobs_timeout", &http_stats.jobs_timeout},
+}
+
+// responseRecorder records the status code and size of a response.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int // 0 until the header is written
+	bytes  int64
+}
+
+func (w *responseRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseRecorder) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(data)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// recordResponse records a response to a thumbnail request that took elapsed.
+// Requests that got no response (because the client went away) are only
+// counted by their error class.
+func recordResponse(w *responseRecorder, elapsed time.Duration) {
+	metrics.requestDuration.observe(elapsed)
+	atomic.AddInt64(&metrics.outputBytes, w.bytes)
+	if w.status != 0 {
+		metrics.mu.Lock()
+		metrics.responses[w.status]++
+		metrics.mu.Unlock()
+	}
+}
+
+// countingReader counts the bytes read through it in *n.
+type countingReader struct {
+	r io.Reader
+	n *int64
+}
+
+func (r countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	atomic.AddInt64(r.n, int64(n))
+	return n, err
+}
+
+// metricsServer serves metrics in the Prometheus text exposition format.
+func metricsServer(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	metrics.mu.Lock()
+	codes := make([]int, 0, len(metrics.responses))
+	for code := range metrics.responses {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	fmt.Fprintf(w, "# HELP thumberd_requests_total Thumbnail requests answered, by status code.\n")
+	fmt.Fprintf(w, "# TYPE thumberd_requests_total counter\n")
+	for _, code := range codes {
+		fmt.Fprintf(w, "thumberd_requests_total{code=\"%d\"} %d\n", code, metrics.responses[code])
+	}
+	metrics.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP thumberd_errors_total Failed requests, by class of error.\n")
+	fmt.Fprintf(w, "# TYPE thumberd_errors_total counter\n")
+	for _, class := range errorClasses {
+		fmt.Fprintf(w, "thumberd_errors_total{class=%q} %d\n", class.name, atomic.LoadInt64(class.counter))
+	}
+
+	fmt.Fprintf(w, "# HELP thumberd_request_duration_seconds Time taken to answer thumbnail requests.\n")
+	fmt.Fprintf(w, "# TYPE thumberd_request_duration_seconds histogram\n")
+	metrics.requestDuration.write(w, "thumberd_request_duration_seconds", "")
+	fmt.Fprintf(w, "# HELP thumberd_phase_duration_seconds Time spent in each phase of making thumbnails.\n")
+	fmt.Fprintf(w, "# TYPE thumberd_phase_duration_seconds histogram\n")
+	for _, phase := range phases {
+		metrics.phaseDuration[phase].write(w, "thumberd_phase_duration_seconds", fmt.Sprintf("phase=%q", phase))
+	}
+
+	counters := []struct {
+		name, help string
+		value      int64
+	}{
+		{"thumberd_input_bytes_total", "Bytes of source images read.", atomic.LoadInt64(&metrics.inputBytes)},
+		{"thumberd_output_bytes_total", "Bytes of thumbnail responses written.", atomic.LoadInt64(&metrics.outputBytes)},
+		{"thumberd_coalesced_total", "Requests that waited for an identical request's thumbnail.", atomic.LoadInt64(&http_stats.coalesced)},
+		{"thumberd_not_modified_total", "Requests answered with 304 Not Modified.", atomic.LoadInt64(&http_stats.not_modified)},
+		{"thumberd_cache_hits_total", "Memory cache hits.", atomic.LoadInt64(&http_stats.cache_hit)},
+		{"thumberd_cache_misses_total", "Memory cache misses.", atomic.LoadInt64(&http_stats.cache_miss)},
+		{"thumberd_cache_evictions_total", "Memory cache evictions.", atomic.LoadInt64(&http_stats.cache_evict)},
+		{"thumberd_disk_cache_hits_total", "Disk cache hits.", atomic.LoadInt64(&http_stats.disk_cache_hit)},
+		{"thumberd_disk_cache_misses_total", "Disk cache misses.", atomic.LoadInt64(&http_stats.disk_cache_miss)},
+		{"thumberd_disk_cache_evictions_total", "Disk cache evictions.", atomic.LoadInt64(&http_stats.disk_cache_evict)},
+	}
+	for _, c := range counters {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", c.name, c.help, c.name, c.name, c.value)
+	}
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	gauges := []struct {
+		name, help string
+		value      int64
+	}{
+		{"thumberd_inflight_requests", "Requests being handled.", atomic.LoadInt64(&http_stats.inflight)},
+		{"thumberd_jobs_running", "Thumbnails being made.", atomic.LoadInt64(&http_stats.jobs_running)},
+		{"thumberd_jobs_queued", "Thumbnails waiting to be made.", atomic.LoadInt64(&http_stats.jobs_queued)},
+		{"thumberd_cache_bytes", "Size of the memory cache.", atomic.LoadInt64(&http_stats.cache_bytes)},
+		{"thumberd_disk_cache_bytes", "Size of the disk cache.", atomic.LoadInt64(&http_stats.disk_cache_bytes)},
+		{"go_goroutines", "Number of goroutines.", int64(runtime.NumGoroutine())},
+		{"go_memstats_heap_alloc_bytes", "Bytes of allocated Go heap objects.", int64(mem.HeapAlloc)},
+		{"go_memstats_sys_bytes", "Bytes of memory obtained from the OS by the Go runtime.", int64(mem.Sys)},
+	}
+	for _, g := range gauges {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", g.name, g.help, g.name, g.name, g.value)
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sourceClient fetches images from configured sources. Unlike client, it may
+// connect to private addresses, since the operator chose them.
+var sourceClient = http.Client{
+	Transport: http.DefaultTransport.(*http.Transport).Clone(),
+}
+
+// The SHA-256 hash of an empty request body
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// s3Source reads images from a bucket in S3 or S3-compatible object storage.
+type s3Source struct {
+	endpoint     *url.URL
+	region       string
+	bucket       string
+	keyPrefix    string // Prepended to the names of images
+	pathStyle    bool   // Address the bucket in the path rather than the host name
+	accessKey    string // Requests are not signed if empty
+	secretKey    string
+	sessionToken string
+}
+
+// newS3Source makes an s3Source from a URL of the form
+// s3://bucket/key-prefix?region=...&endpoint=...&path_style=1. Credentials
+// are taken from the access_key, secret_key and session_token parameters, or
+// else from the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN
+// environment variables.
+func newS3Source(u *url.URL) (*s3Source, error) {
+	if u.Host == "" {
+		return nil, errors.New("S3 source needs a bucket")
+	}
+	q := u.Query()
+	s := &s3Source{
+		region:       q.Get("region"),
+		bucket:       u.Host,
+		keyPrefix:    strings.TrimPrefix(u.Path, "/"),
+		accessKey:    q.Get("access_key"),
+		secretKey:    q.Get("secret_key"),
+		sessionToken: q.Get("session_token"),
+	}
+	if s.keyPrefix != "" && !strings.HasSuffix(s.keyPrefix, "/") {
+		s.keyPrefix += "/"
+	}
+	if s.region == "" {
+		s.region = "us-east-1"
+	}
+	if s.accessKey == "" {
+		s.accessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+		s.secretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		s.sessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	}
+	if pathStyle := q.Get("path_style"); pathStyle != "" {
+		var err error
+		if s.pathStyle, err = strconv.ParseBool(pathStyle); err != nil {
+			return nil, errors.New("path_style must be 0 or 1")
+		}
+	}
+	endpoint := q.Get("endpoint")
+	if endpoint == "" {
+		endpoint = "https://s3." + s.region + ".amazonaws.com"
+	}
+	var err error
+	s.endpoint, err = url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if (s.endpoint.Scheme != "http" && s.endpoint.Scheme != "https") || s.endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", endpoint)
+	}
+	return s, nil
+}
+
+// escapeS3Path escapes a path as required by S3 and signature version 4:
+// everything but unreserved characters and slashes.
+func escapeS3Path(p string) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-._~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func (s *s3Source) open(ctx context.Context, name string, cond conditions) (io.ReadCloser, *sourceInfo, error) {
+	// The name is still escaped, and may have a query string
+	if i := strings.IndexByte(name, '?'); i >= 0 {
+		name = name[:i]
+	}
+	name, err := url.PathUnescape(name)
+	if err != nil {
+		return nil, nil, &upstreamError{http.StatusBadRequest, "invalid path"}
+	}
+	// Keys are taken literally, but anything between here and the storage
+	// may resolve dot segments and escape the key prefix (or the bucket).
+	for _, segment := range strings.Split(name, "/") {
+		if segment == "." || segment == ".." {
+			return nil, nil, &upstreamError{http.StatusBadRequest, "invalid path"}
+		}
+	}
+
+	u := *s.endpoint
+	base := strings.TrimSuffix(u.Path, "/")
+	if s.pathStyle {
+		u.Path = base + "/" + s.bucket + "/" + s.keyPrefix + name
+	} else {
+		u.Host = s.bucket + "." + u.Host
+		u.Path = base + "/" + s.keyPrefix + name
+	}
+	u.RawPath = escapeS3Path(u.Path)
+	u.RawQuery = ""
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, nil, &upstreamError{http.StatusBadRequest, "invalid path"}
+	}
+	req.Header = cond.header()
+	if s.accessKey != "" {
+		if s.sessionToken != "" {
+			req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+		}
+		signV4(req, s.accessKey, s.secretKey, s.region, time.Now())
+	}
+
+	res, err := sourceClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, nil, &upstreamError{http.StatusBadGateway, err.Error()}
+	}
+	if res.StatusCode == http.StatusNotModified {
+		res.Body.Close()
+		return nil, responseInfo(res), errNotModified
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, nil, &upstreamError{res.StatusCode, res.Status}
+	}
+	return res.Body, responseInfo(res), nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// signV4 signs a request without a body for S3 with AWS signature version 4,
+// covering the host and all the headers already set on req.
+func signV4(req *http.Request, accessKey, secretKey, region string, now time.Time) {
+	date := now.UTC().Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", date)
+	req.Header.Set("X-Amz-Content-Sha256", emptySHA256)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		emptySHA256,
+	}, "\n")
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	scope := date[:8] + "/" + region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + date + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date[:8])
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
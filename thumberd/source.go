@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var errNotModified = errors.New("not modified")
+
+// source provides source images.
+type source interface {
+	// open returns the image at name and information about it. If the image
+	// matches cond, it returns errNotModified instead of the image (but
+	// still returns the information). Failures to find or fetch the image
+	// are returned as an *upstreamError.
+	open(ctx context.Context, name string, cond conditions) (io.ReadCloser, *sourceInfo, error)
+}
+
+// sourceInfo describes a source image.
+type sourceInfo struct {
+	modified     time.Time // When it was last modified, or zero if unknown
+	etag         string    // Its ETag, or empty if unknown
+	cacheControl string    // How long it may be cached, as a Cache-Control header
+}
+
+// conditions identify a version of a source image, to make a request for it
+// conditional on it having changed. The zero value matches nothing.
+type conditions struct {
+	etags    []string  // ETags, any of which matches
+	modified time.Time // Matches if the image hasn't been modified since
+}
+
+// header sets conditional request headers for cond.
+func (cond conditions) header() http.Header {
+	header := make(http.Header)
+	if len(cond.etags) > 0 {
+		header.Set("If-None-Match", strings.Join(cond.etags, ", "))
+	} else if !cond.modified.IsZero() {
+		header.Set("If-Modified-Since", cond.modified.UTC().Format(http.TimeFormat))
+	}
+	return header
+}
+
+// sourceRoute routes upstream components starting with prefix and a slash to
+// src, without the prefix.
+type sourceRoute struct {
+	prefix string
+	src    source
+}
+
+// sourceRoutes are the sources configured with -source. Upstreams that don't
+// match any of them are fetched over HTTP.
+var sourceRoutes []sourceRoute
+
+// sourceFlag adds a route to sourceRoutes for each -source flag.
+type sourceFlag struct{}
+
+func (sourceFlag) String() string {
+	return ""
+}
+
+func (sourceFlag) Set(value string) error {
+	tup := strings.SplitN(value, "=", 2)
+	if len(tup) != 2 || tup[0] == "" || strings.Contains(tup[0], "/") {
+		return errors.New("source must have the form prefix=url")
+	}
+	u, err := url.Parse(tup[1])
+	if err != nil {
+		return err
+	}
+	var src source
+	switch u.Scheme {
+	case "file":
+		if u.Path == "" {
+			return errors.New("file source needs a directory")
+		}
+		src = &fileSource{root: u.Path}
+	case "s3":
+		if src, err = newS3Source(u); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unsupported source type %q", u.Scheme)
+	}
+	sourceRoutes = append(sourceRoutes, sourceRoute{tup[0], src})
+	return nil
+}
+
+func init() {
+	flag.Var(sourceFlag{}, "source", "serve upstreams starting with prefix/ from a source given as prefix=url, e.g. local=file:///srv/images or photos=s3://bucket?region=ap-northeast-1 (repeatable)")
+}
+
+// openSource opens the upstream component of a request path.
+func openSource(ctx context.Context, upstream string, cond conditions) (io.ReadCloser, *sourceInfo, error) {
+	for _, route := range sourceRoutes {
+		if strings.HasPrefix(upstream, route.prefix+"/") {
+			return route.src.open(ctx, upstream[len(route.prefix)+1:], cond)
+		}
+	}
+	return httpSource{}.open(ctx, upstream, cond)
+}
+
+// responseInfo returns the information about a source image in the headers
+// of an HTTP response for it.
+func responseInfo(res *http.Response) *sourceInfo {
+	modified, _ := http.ParseTime(res.Header.Get("Last-Modified"))
+	return &sourceInfo{
+		modified:     modified,
+		etag:         res.Header.Get("ETag"),
+		cacheControl: res.Header.Get("Cache-Control"),
+	}
+}
+
+// httpSource fetches images from upstream HTTP(S) servers.
+type httpSource struct{}
+
+func (httpSource) open(ctx context.Context, name string, cond conditions) (io.ReadCloser, *sourceInfo, error) {
+	res, err := getUpstream(ctx, upstreamURL(name), cond.header())
+	if errors.Is(err, errUpstreamNotAllowed) {
+		return nil, nil, err
+	} else if err != nil {
+		return nil, nil, &upstreamError{http.StatusBadGateway, err.Error()}
+	}
+	if res.StatusCode == http.StatusNotModified {
+		res.Body.Close()
+		return nil, responseInfo(res), errNotModified
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, nil, &upstreamError{res.StatusCode, res.Status}
+	}
+	return res.Body, responseInfo(res), nil
+}
+
+// fileSource reads images from files under root.
+type fileSource struct {
+	root string
+}
+
+func (s *fileSource) open(ctx context.Context, name string, cond conditions) (io.ReadCloser, *sourceInfo, error) {
+	// The name is still escaped, and may have a query string
+	if i := strings.IndexByte(name, '?'); i >= 0 {
+		name = name[:i]
+	}
+	name, err := url.PathUnescape(name)
+	if err != nil {
+		return nil, nil, &upstreamError{http.StatusBadRequest, "invalid path"}
+	}
+	// Cleaning the name as an absolute path removes any .. that would
+	// escape root, and opening it in root refuses symlinks that lead out of
+	// it.
+	name = filepath.FromSlash(path.Clean("/" + name))
+
+	f, err := os.OpenInRoot(s.root, "."+name)
+	if err != nil {
+		if !os.IsNotExist(err) && !os.IsPermission(err) {
+			// The error for escaping root isn't exported, but the file
+			// then exists outside of it. Don't reveal that.
+			if _, statErr := os.Stat(filepath.Join(s.root, name)); statErr == nil {
+				err = os.ErrNotExist
+			}
+		}
+		return nil, nil, fileError(err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, fileError(err)
+	}
+	if !fi.Mode().IsRegular() {
+		f.Close()
+		return nil, nil, &upstreamError{http.StatusNotFound, http.StatusText(http.StatusNotFound)}
+	}
+	info := &sourceInfo{modified: fi.ModTime()}
+	// Files have no ETags, so only the modification time can match. HTTP
+	// dates have a resolution of a second.
+	if !cond.modified.IsZero() && !fi.ModTime().Truncate(time.Second).After(cond.modified) {
+		f.Close()
+		return nil, info, errNotModified
+	}
+	return f, info, nil
+}
+
+// fileError converts an error opening a file to an *upstreamError, without
+// revealing the file name.
+func fileError(err error) error {
+	status := http.StatusInternalServerError
+	switch {
+	case os.IsNotExist(err):
+		status = http.StatusNotFound
+	case os.IsPermission(err):
+		status = http.StatusForbidden
+	}
+	return &upstreamError{status, http.StatusText(status)}
+}
@@ -1,13 +1,18 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"image/color"
+	"io"
 	"log"
 	"net"
 	"net/http"
 	"net/http/fcgi"
-	"net/url"
 	"os"
 	"runtime"
 	"strconv"
@@ -15,14 +20,37 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/pixiv/go-thumber/jpeg"
 	"github.com/pixiv/go-thumber/thumbnail"
+	"github.com/pixiv/go-thumber/urlsign"
 )
 
 var local = flag.String("local", "", "serve as webserver, example: 0.0.0.0:8000, /var/run/go-thumber.sock")
 var timeout = flag.Int("timeout", 3, "timeout for upstream HTTP requests, in seconds")
 var show_version = flag.Bool("version", false, "show version and exit")
+var max_source_pixels = flag.Int64("max-source-pixels", 100000000, "reject source images with more pixels than this (0 for no limit)")
+var max_scans = flag.Int("max-scans", 100, "reject progressive source images with more scans than this (0 for no limit)")
+var max_memory = flag.Int64("max-memory", 0, "limit on libjpeg memory use per request, in bytes (0 for no limit)")
+var cache_size = flag.Int64("cache-size", 0, "size of the in-memory thumbnail cache, in bytes (0 to disable)")
+var cache_ttl = flag.Int("cache-ttl", 3600, "time to keep thumbnails in the cache, in seconds (0 for no expiry)")
+var disk_cache_dir = flag.String("disk-cache-dir", "", "directory for the persistent thumbnail cache (empty to disable)")
+var disk_cache_size = flag.Int64("disk-cache-size", 1<<30, "size of the persistent thumbnail cache, in bytes")
+var max_jobs = flag.Int("max-jobs", 0, "limit on thumbnails being made at once (0 for no limit)")
+var max_job_pixels = flag.Int64("max-job-pixels", 0, "limit on the total source pixels of thumbnails being made at once (0 for no limit)")
+var queue_size = flag.Int("queue-size", 100, "requests allowed to wait when -max-jobs or -max-job-pixels is reached")
+var queue_timeout = flag.Int("queue-timeout", 5, "time requests may wait for their turn, in seconds")
+var sign_keys = flag.String("sign-keys", "", "file of secret keys, one per line; if set, only signed URLs are served")
 
-var client http.Client
+// thumbCache and thumbDiskCache cache thumbnails by parameters and upstream
+// URL, if enabled.
+var thumbCache *cache
+var thumbDiskCache *diskCache
+
+// signKeys are the keys that URLs may be signed with, if signing is required.
+var signKeys [][]byte
+
+// jobAdmission limits the thumbnails being made at once, if enabled.
+var jobAdmission *admission
 
 var version string
 
@@ -30,13 +58,34 @@ const maxDimension = 65000
 const maxPixels = 10000000
 
 var http_stats struct {
-	received       int64
-	inflight       int64
-	ok             int64
-	thumb_error    int64
-	upstream_error int64
-	arg_error      int64
-	total_time_us  int64
+	received          int64
+	inflight          int64
+	ok                int64
+	thumb_error       int64
+	corrupt_error     int64
+	unsupported_error int64
+	limit_error       int64
+	write_error       int64
+	canceled          int64
+	not_modified      int64
+	coalesced         int64
+	upstream_error    int64
+	arg_error         int64
+	blocked_upstream  int64
+	sign_error        int64
+	total_time_us     int64
+	cache_hit         int64
+	cache_miss        int64
+	cache_evict       int64
+	cache_bytes       int64
+	disk_cache_hit    int64
+	disk_cache_miss   int64
+	disk_cache_evict  int64
+	disk_cache_bytes  int64
+	jobs_running      int64
+	jobs_queued       int64
+	jobs_rejected     int64
+	jobs_timeout      int64
 }
 
 func init() {
@@ -54,16 +103,130 @@ func statusServer(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "inflight %d\n", atomic.LoadInt64(&http_stats.inflight))
 	fmt.Fprintf(w, "ok %d\n", atomic.LoadInt64(&http_stats.ok))
 	fmt.Fprintf(w, "thumb_error %d\n", atomic.LoadInt64(&http_stats.thumb_error))
+	fmt.Fprintf(w, "corrupt_error %d\n", atomic.LoadInt64(&http_stats.corrupt_error))
+	fmt.Fprintf(w, "unsupported_error %d\n", atomic.LoadInt64(&http_stats.unsupported_error))
+	fmt.Fprintf(w, "limit_error %d\n", atomic.LoadInt64(&http_stats.limit_error))
+	fmt.Fprintf(w, "write_error %d\n", atomic.LoadInt64(&http_stats.write_error))
+	fmt.Fprintf(w, "canceled %d\n", atomic.LoadInt64(&http_stats.canceled))
+	fmt.Fprintf(w, "not_modified %d\n", atomic.LoadInt64(&http_stats.not_modified))
+	fmt.Fprintf(w, "coalesced %d\n", atomic.LoadInt64(&http_stats.coalesced))
 	fmt.Fprintf(w, "upstream_error %d\n", atomic.LoadInt64(&http_stats.upstream_error))
 	fmt.Fprintf(w, "arg_error %d\n", atomic.LoadInt64(&http_stats.arg_error))
+	fmt.Fprintf(w, "blocked_upstream %d\n", atomic.LoadInt64(&http_stats.blocked_upstream))
+	fmt.Fprintf(w, "sign_error %d\n", atomic.LoadInt64(&http_stats.sign_error))
 	fmt.Fprintf(w, "total_time_us %d\n", atomic.LoadInt64(&http_stats.total_time_us))
+	fmt.Fprintf(w, "cache_hit %d\n", atomic.LoadInt64(&http_stats.cache_hit))
+	fmt.Fprintf(w, "cache_miss %d\n", atomic.LoadInt64(&http_stats.cache_miss))
+	fmt.Fprintf(w, "cache_evict %d\n", atomic.LoadInt64(&http_stats.cache_evict))
+	fmt.Fprintf(w, "cache_bytes %d\n", atomic.LoadInt64(&http_stats.cache_bytes))
+	fmt.Fprintf(w, "disk_cache_hit %d\n", atomic.LoadInt64(&http_stats.disk_cache_hit))
+	fmt.Fprintf(w, "disk_cache_miss %d\n", atomic.LoadInt64(&http_stats.disk_cache_miss))
+	fmt.Fprintf(w, "disk_cache_evict %d\n", atomic.LoadInt64(&http_stats.disk_cache_evict))
+	fmt.Fprintf(w, "disk_cache_bytes %d\n", atomic.LoadInt64(&http_stats.disk_cache_bytes))
+	fmt.Fprintf(w, "jobs_running %d\n", atomic.LoadInt64(&http_stats.jobs_running))
+	fmt.Fprintf(w, "jobs_queued %d\n", atomic.LoadInt64(&http_stats.jobs_queued))
+	fmt.Fprintf(w, "jobs_rejected %d\n", atomic.LoadInt64(&http_stats.jobs_rejected))
+	fmt.Fprintf(w, "jobs_timeout %d\n", atomic.LoadInt64(&http_stats.jobs_timeout))
+}
+
+// parseColor parses a color given as RRGGBB hex digits.
+func parseColor(s string) (color.Color, error) {
+	if len(s) != 6 {
+		return nil, errors.New("color must have the form RRGGBB")
+	}
+	val, err := strconv.ParseUint(s, 16, 32)
+	if err != nil {
+		return nil, err
+	}
+	return color.RGBA{uint8(val >> 16), uint8(val >> 8), uint8(val), 0xff}, nil
+}
+
+// checkSignature verifies the signature of path if signing is required, and
+// responds with 403 if it is invalid.
+func checkSignature(w http.ResponseWriter, path string) bool {
+	if signKeys == nil {
+		return true
+	}
+	if err := urlsign.Verify(signKeys, path, time.Now()); err != nil {
+		http.Error(w, "Forbidden: "+err.Error(), http.StatusForbidden)
+		atomic.AddInt64(&http_stats.sign_error, 1)
+		return false
+	}
+	return true
+}
+
+// getUpstream fetches url with the given request headers, giving up once ctx
+// is done. Upstreams that aren't allowed fail with an error wrapping
+// errUpstreamNotAllowed.
+func getUpstream(ctx context.Context, url string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = header
+	if err := checkURL(req.URL); err != nil {
+		return nil, err
+	}
+	return client.Do(req.WithContext(ctx))
+}
+
+// upstreamError is returned by makeThumbnail when the upstream request fails.
+type upstreamError struct {
+	status int // HTTP status code to respond with
+	msg    string
+}
+
+func (e *upstreamError) Error() string {
+	return e.msg
+}
+
+// thumbError maps an error returned by MakeThumbnail to an HTTP status code
+// and the http_stats counter to increment. A zero status code means that no
+// response can be sent.
+func thumbError(err error) (int, *int64) {
+	var readErr *jpeg.ReadError
+	var writeErr *jpeg.WriteError
+	var upstreamErr *upstreamError
+	switch {
+	case errors.Is(err, context.Canceled):
+		// The client went away, or the request was otherwise aborted
+		return 0, &http_stats.canceled
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout, &http_stats.canceled
+	case errors.Is(err, errQueueFull):
+		return http.StatusServiceUnavailable, &http_stats.jobs_rejected
+	case errors.Is(err, errQueueTimeout):
+		return http.StatusServiceUnavailable, &http_stats.jobs_timeout
+	case errors.Is(err, errUpstreamNotAllowed):
+		return http.StatusForbidden, &http_stats.blocked_upstream
+	case errors.As(err, &upstreamErr):
+		return upstreamErr.status, &http_stats.upstream_error
+	case errors.As(err, &readErr):
+		return http.StatusBadGateway, &http_stats.upstream_error
+	case errors.As(err, &writeErr):
+		// The client went away
+		return 0, &http_stats.write_error
+	case errors.Is(err, jpeg.ErrUnsupportedColorspace), errors.Is(err, jpeg.ErrUnsupportedSubsampling):
+		return http.StatusUnsupportedMediaType, &http_stats.unsupported_error
+	case errors.Is(err, jpeg.ErrSourceTooLarge), errors.Is(err, jpeg.ErrTooManyScans), errors.Is(err, jpeg.ErrMemoryLimit):
+		return http.StatusUnprocessableEntity, &http_stats.limit_error
+	case errors.Is(err, jpeg.ErrCorrupt), errors.Is(err, jpeg.ErrEmptyInput):
+		return http.StatusUnprocessableEntity, &http_stats.corrupt_error
+	default:
+		return http.StatusInternalServerError, &http_stats.thumb_error
+	}
 }
 
 func thumbServer(w http.ResponseWriter, r *http.Request) {
 	startTime := time.Now()
+	rec := &responseRecorder{ResponseWriter: w}
+	w = rec
+	entry := &accessLogEntry{}
 	defer func() {
-		elapsed := int64(time.Now().Sub(startTime) / 1000)
-		atomic.AddInt64(&http_stats.total_time_us, elapsed)
+		elapsed := time.Now().Sub(startTime)
+		atomic.AddInt64(&http_stats.total_time_us, int64(elapsed/1000))
+		recordResponse(rec, elapsed)
+		logAccess(entry, rec, r, startTime)
 	}()
 
 	atomic.AddInt64(&http_stats.received, 1)
@@ -78,33 +241,43 @@ func thumbServer(w http.ResponseWriter, r *http.Request) {
 		ForceAspect:    true,
 		Quality:        90,
 		Optimize:       false,
+		Metadata:       jpeg.KeepICC,
 		PrescaleFactor: 2.0,
+
+		MaxSourcePixels: *max_source_pixels,
+		MaxScans:        *max_scans,
+		MaxMemory:       *max_memory,
 	}
 
 	if path[0] != '/' {
 		http.Error(w, "Path should start with /", http.StatusBadRequest)
-		atomic.AddInt64(&http_stats.arg_error, 1)
+		entry.fail(&http_stats.arg_error)
 		return
 	}
 	parts := strings.SplitN(path[1:], "/", 2)
 	if len(parts) < 2 {
 		http.Error(w, "Path needs to have at least two components", http.StatusBadRequest)
-		atomic.AddInt64(&http_stats.arg_error, 1)
+		entry.fail(&http_stats.arg_error)
+		return
+	}
+	entry.Params, entry.UpstreamHost = parts[0], upstreamHost(parts[1])
+	if !checkSignature(w, path) {
+		entry.Error = "sign_error"
 		return
 	}
 	for _, arg := range strings.Split(parts[0], ",") {
 		tup := strings.SplitN(arg, "=", 2)
 		if len(tup) != 2 {
 			http.Error(w, "Arguments must have the form name=value", http.StatusBadRequest)
-			atomic.AddInt64(&http_stats.arg_error, 1)
+			entry.fail(&http_stats.arg_error)
 			return
 		}
 		switch tup[0] {
-		case "w", "h", "q", "u", "a", "o":
+		case "w", "h", "q", "u", "a", "c", "pad", "r", "o", "pr", "m":
 			val, err := strconv.Atoi(tup[1])
 			if err != nil {
 				http.Error(w, "Invalid integer value for "+tup[0], http.StatusBadRequest)
-				atomic.AddInt64(&http_stats.arg_error, 1)
+				entry.fail(&http_stats.arg_error)
 				return
 			}
 			switch tup[0] {
@@ -118,68 +291,282 @@ func thumbServer(w http.ResponseWriter, r *http.Request) {
 				params.Upscale = val != 0
 			case "a":
 				params.ForceAspect = val != 0
+			case "c":
+				params.Crop = val != 0
+			case "pad":
+				params.Pad = val != 0
+			case "r":
+				params.NoOrient = val == 0
 			case "o":
 				params.Optimize = val != 0
+			case "pr":
+				params.Progressive = val != 0
+			case "m":
+				params.Metadata = jpeg.MetadataPolicy(val)
 			}
 		case "p":
 			val, err := strconv.ParseFloat(tup[1], 64)
 			if err != nil {
 				http.Error(w, "Invalid float value for "+tup[0], http.StatusBadRequest)
-				atomic.AddInt64(&http_stats.arg_error, 1)
+				entry.fail(&http_stats.arg_error)
 				return
 			}
 			params.PrescaleFactor = val
+		case "g":
+			val, err := thumbnail.ParseGravity(tup[1])
+			if err != nil {
+				http.Error(w, "Invalid gravity value for "+tup[0], http.StatusBadRequest)
+				entry.fail(&http_stats.arg_error)
+				return
+			}
+			params.Gravity = val
+		case "bg":
+			val, err := parseColor(tup[1])
+			if err != nil {
+				http.Error(w, "Invalid color value for "+tup[0], http.StatusBadRequest)
+				entry.fail(&http_stats.arg_error)
+				return
+			}
+			params.Background = val
+		case "ss":
+			val, err := thumbnail.ParseSubsampling(tup[1])
+			if err != nil {
+				http.Error(w, "Invalid subsampling value for "+tup[0], http.StatusBadRequest)
+				entry.fail(&http_stats.arg_error)
+				return
+			}
+			params.Subsampling = val
 		}
 	}
 	if params.Width <= 0 || params.Width > maxDimension {
 		http.Error(w, "Width (w) not specified or invalid", http.StatusBadRequest)
-		atomic.AddInt64(&http_stats.arg_error, 1)
+		entry.fail(&http_stats.arg_error)
 		return
 	}
 	if params.Height <= 0 || params.Height > maxDimension {
 		http.Error(w, "Height (h) not specified or invalid", http.StatusBadRequest)
-		atomic.AddInt64(&http_stats.arg_error, 1)
+		entry.fail(&http_stats.arg_error)
 		return
 	}
 	if params.Width*params.Height > maxPixels {
 		http.Error(w, "Image dimensions are insane", http.StatusBadRequest)
-		atomic.AddInt64(&http_stats.arg_error, 1)
+		entry.fail(&http_stats.arg_error)
 		return
 	}
 	if params.Quality > 100 || params.Quality < 0 {
 		http.Error(w, "Quality must be between 0 and 100", http.StatusBadRequest)
-		atomic.AddInt64(&http_stats.arg_error, 1)
+		entry.fail(&http_stats.arg_error)
+		return
+	}
+	if params.Metadata < jpeg.StripMetadata || params.Metadata > jpeg.KeepMetadata {
+		http.Error(w, "Metadata (m) must be 0, 1 or 2", http.StatusBadRequest)
+		entry.fail(&http_stats.arg_error)
 		return
 	}
 
-	srcReader, err := client.Get("http://" + parts[1])
-	if err != nil {
-		http.Error(w, "Upstream failed: "+err.Error(), http.StatusBadGateway)
-		atomic.AddInt64(&http_stats.upstream_error, 1)
+	// The parsed parameters are the same however they were written in the URL
+	cacheKey := fmt.Sprintf("%+v %s", params, parts[1])
+	if t, ok := getCached(cacheKey); ok {
+		entry.describe(t, true)
+		setTimingHeaders(w, t, true, startTime)
+		writeThumb(w, r, t, entry)
 		return
 	}
-	if srcReader.StatusCode != http.StatusOK {
-		http.Error(w, "Upstream failed: "+srcReader.Status, srcReader.StatusCode)
-		atomic.AddInt64(&http_stats.upstream_error, 1)
+
+	// Conditional requests are passed on to the source, so that the
+	// thumbnail isn't made if the client's copy is still valid. Identical
+	// requests that arrive while the thumbnail is being made wait for it,
+	// rather than making it again.
+	cond := sourceConditions(r, cacheKey)
+	flightKey := cacheKey
+	if len(cond.etags) > 0 || !cond.modified.IsZero() {
+		flightKey = fmt.Sprintf("%s %v", cacheKey, cond)
+	}
+	t, err := flights.do(r.Context(), flightKey, func(ctx context.Context) (*thumb, error) {
+		return makeThumbnail(ctx, parts[1], cond, params, cacheKey)
+	})
+	if errors.Is(err, errNotModified) {
+		entry.UpstreamStatus = http.StatusNotModified
+		entry.describe(t, false)
+		setTimingHeaders(w, t, false, startTime)
+		setCacheHeaders(w, t)
+		w.WriteHeader(http.StatusNotModified)
+		atomic.AddInt64(&http_stats.not_modified, 1)
+		return
+	} else if err != nil {
+		status, counter := thumbError(err)
+		entry.fail(counter)
+		var upstreamErr *upstreamError
+		if errors.As(err, &upstreamErr) {
+			entry.UpstreamStatus = upstreamErr.status
+		}
+		if status == http.StatusServiceUnavailable {
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter()))
+		}
+		if counter == &http_stats.upstream_error || counter == &http_stats.blocked_upstream {
+			http.Error(w, "Upstream failed: "+err.Error(), status)
+		} else if status != 0 {
+			http.Error(w, "Thumbnailing failed: "+err.Error(), status)
+		}
 		return
 	}
 
+	entry.UpstreamStatus = http.StatusOK
+	entry.describe(t, false)
+	setTimingHeaders(w, t, false, startTime)
+	writeThumb(w, r, t, entry)
+}
+
+// writeThumb responds with t, or with 304 if the request's conditional
+// headers match it. Failures are recorded in entry.
+func writeThumb(w http.ResponseWriter, r *http.Request, t *thumb, entry *accessLogEntry) {
+	setCacheHeaders(w, t)
+	if notModified(r, t) {
+		w.WriteHeader(http.StatusNotModified)
+		atomic.AddInt64(&http_stats.not_modified, 1)
+		return
+	}
 	w.Header().Set("Content-Type", "image/jpeg")
-	w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
-	err = thumbnail.MakeThumbnail(srcReader.Body, w, params)
+	if _, err := w.Write(t.data); err != nil {
+		entry.fail(&http_stats.write_error)
+		return
+	}
+	atomic.AddInt64(&http_stats.ok, 1)
+}
+
+// thumb is a thumbnail made by makeThumbnail.
+type thumb struct {
+	data         []byte
+	created      time.Time // When the thumbnail was made
+	modified     time.Time // When the source was last modified, if known, or created
+	etag         string
+	cacheControl string // The Cache-Control header of the source, if any
+
+	// How the thumbnail was made. These are not kept in the disk cache.
+	upstreamTime time.Duration // Opening the source
+	queueTime    time.Duration // Waiting for jobAdmission
+	stats        thumbnail.Stats
+}
+
+// makeThumbnail opens upstream and thumbnails it, adding the thumbnail to the
+// caches under cacheKey. If the source matches cond, it returns errNotModified
+// and a thumb without data instead. Upstream failures are returned as an
+// *upstreamError, unless the upstream isn't allowed.
+func makeThumbnail(ctx context.Context, upstream string, cond conditions, params thumbnail.ThumbnailParameters, cacheKey string) (*thumb, error) {
+	start := time.Now()
+	srcReader, info, err := openSource(ctx, upstream, cond)
+	upstreamTime := time.Now().Sub(start)
+	metrics.phaseDuration["upstream"].observe(upstreamTime)
+	if err == errNotModified {
+		// Describe the thumbnail the client already has
+		t := &thumb{modified: info.modified, cacheControl: info.cacheControl, upstreamTime: upstreamTime}
+		if t.modified.IsZero() {
+			t.modified = cond.modified
+		}
+		if info.etag == "" && len(cond.etags) > 0 {
+			info.etag = cond.etags[0]
+		}
+		t.etag = thumbETag(cacheKey, info, t.modified)
+		return t, err
+	} else if err != nil {
+		return nil, err
+	}
+	defer srcReader.Close()
+
+	src := io.Reader(countingReader{srcReader, &metrics.inputBytes})
+	var queueTime time.Duration
+	if jobAdmission != nil {
+		var pixels int64
+		if jobAdmission.maxPixels > 0 {
+			// Weigh the job by the size of the source. The header that
+			// was read is passed on to the decoder.
+			var head bytes.Buffer
+			if info, err := jpeg.ReadHeader(io.TeeReader(src, &head)); err == nil {
+				pixels = int64(info.Width) * int64(info.Height)
+			}
+			src = io.MultiReader(&head, src)
+		}
+		start = time.Now()
+		if err := jobAdmission.acquire(ctx, pixels); err != nil {
+			return nil, err
+		}
+		queueTime = time.Now().Sub(start)
+		metrics.phaseDuration["queue"].observe(queueTime)
+		defer jobAdmission.release(pixels)
+	}
+
+	t := &thumb{created: time.Now(), modified: info.modified, cacheControl: info.cacheControl,
+		upstreamTime: upstreamTime, queueTime: queueTime}
+	if t.modified.IsZero() {
+		t.modified = t.created
+	}
+	t.etag = thumbETag(cacheKey, info, t.modified)
+	var buf bytes.Buffer
+	t.stats, err = thumbnail.MakeThumbnailStats(ctx, src, &buf, params)
 	if err != nil {
-		switch err := err.(type) {
-		case *url.Error:
-			http.Error(w, "Upstream failed: "+err.Error(), http.StatusBadGateway)
-			atomic.AddInt64(&http_stats.upstream_error, 1)
-			return
-		default:
-			http.Error(w, "Thumbnailing failed: "+err.Error(), http.StatusInternalServerError)
-			atomic.AddInt64(&http_stats.thumb_error, 1)
+		return nil, err
+	}
+	metrics.phaseDuration["decode"].observe(t.stats.DecodeTime)
+	metrics.phaseDuration["scale"].observe(t.stats.ScaleTime)
+	metrics.phaseDuration["encode"].observe(t.stats.EncodeTime)
+	t.data = buf.Bytes()
+	putCached(cacheKey, t)
+	return t, nil
+}
+
+// retryAfter returns the number of seconds that clients turned away by
+// jobAdmission should wait before trying again.
+func retryAfter() int {
+	if *queue_timeout < 1 {
+		return 1
+	}
+	return *queue_timeout
+}
+
+// infoServer describes an upstream JPEG as JSON, reading only its header.
+func infoServer(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt64(&http_stats.received, 1)
+	atomic.AddInt64(&http_stats.inflight, 1)
+	defer atomic.AddInt64(&http_stats.inflight, -1)
+
+	path := strings.TrimPrefix(r.URL.RequestURI(), "/info/")
+	if path == "" {
+		http.Error(w, "Path needs to have an upstream component", http.StatusBadRequest)
+		atomic.AddInt64(&http_stats.arg_error, 1)
+		return
+	}
+	if signKeys != nil {
+		// Signed info paths have an argument segment (with the signature)
+		// before the upstream component, like thumbnail paths.
+		if !checkSignature(w, "/"+path) {
 			return
 		}
+		path = path[strings.Index(path, "/")+1:]
 	}
-	srcReader.Body.Close()
+
+	src, _, err := openSource(r.Context(), path, conditions{})
+	if err != nil {
+		status, counter := thumbError(err)
+		atomic.AddInt64(counter, 1)
+		if status != 0 {
+			http.Error(w, "Upstream failed: "+err.Error(), status)
+		}
+		return
+	}
+	defer src.Close()
+
+	info, err := jpeg.ReadHeader(src)
+	if err != nil {
+		status, counter := thumbError(err)
+		atomic.AddInt64(counter, 1)
+		if status != 0 {
+			http.Error(w, "Reading header failed: "+err.Error(), status)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
 	atomic.AddInt64(&http_stats.ok, 1)
 }
 
@@ -191,11 +578,49 @@ func main() {
 	}
 
 	client.Timeout = time.Duration(*timeout) * time.Second
+	sourceClient.Timeout = client.Timeout
 
-	var err error
+	err := configureTLS(client.Transport.(*http.Transport), *upstream_ca, *upstream_cert, *upstream_key)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = configureTLS(sourceClient.Transport.(*http.Transport), *upstream_ca, "", "")
+	if err != nil {
+		log.Fatal(err)
+	}
+	allowHosts, err = parseAllowHosts(*allow_hosts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *sign_keys != "" {
+		signKeys, err = urlsign.ReadKeys(*sign_keys)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *cache_size > 0 {
+		thumbCache = newCache(*cache_size, time.Duration(*cache_ttl)*time.Second)
+	}
+	if *disk_cache_dir != "" {
+		thumbDiskCache, err = newDiskCache(*disk_cache_dir, *disk_cache_size, time.Duration(*cache_ttl)*time.Second)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *max_jobs > 0 || *max_job_pixels > 0 {
+		jobAdmission = newAdmission(*max_jobs, *max_job_pixels, *queue_size, time.Duration(*queue_timeout)*time.Second)
+	}
+	if *access_log != "" {
+		accessLog, err = newAccessLogger(*access_log)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
 
 	http.HandleFunc("/server-status", statusServer)
+	http.HandleFunc("/metrics", metricsServer)
 	http.HandleFunc("/favicon.ico", errorServer)
+	http.HandleFunc("/info/", infoServer)
 
 	http.HandleFunc("/", thumbServer)
 
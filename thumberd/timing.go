@@ -0,0 +1,53 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var debug_headers = flag.Bool("debug-headers", false, "describe how thumbnails were made in X-Thumber-* response headers")
+
+// setTimingHeaders sets a Server-Timing header with the time spent in each
+// phase of making t, or a cache hit if it was cached, and the total time since
+// start. With -debug-headers, it also sets X-Thumber-* headers with the
+// dimensions of the source and the prescale factor chosen for decoding it.
+func setTimingHeaders(w http.ResponseWriter, t *thumb, cached bool, start time.Time) {
+	var timings []string
+	if cached {
+		timings = append(timings, `cache;desc="hit"`)
+	} else {
+		for _, phase := range []struct {
+			name string
+			d    time.Duration
+		}{
+			{"queue", t.queueTime},
+			{"upstream", t.upstreamTime},
+			{"decode", t.stats.DecodeTime},
+			{"scale", t.stats.ScaleTime},
+			{"encode", t.stats.EncodeTime},
+		} {
+			// Phases that didn't happen are left out
+			if phase.d > 0 {
+				timings = append(timings, serverTiming(phase.name, phase.d))
+			}
+		}
+	}
+	timings = append(timings, serverTiming("total", time.Now().Sub(start)))
+	w.Header().Set("Server-Timing", strings.Join(timings, ", "))
+
+	// Thumbnails from the disk cache, or not made at all, have no stats
+	if *debug_headers && t.stats.SourceWidth > 0 {
+		w.Header().Set("X-Thumber-Source-Size", fmt.Sprintf("%dx%d", t.stats.SourceWidth, t.stats.SourceHeight))
+		w.Header().Set("X-Thumber-Decoded-Size", fmt.Sprintf("%dx%d", t.stats.DecodedWidth, t.stats.DecodedHeight))
+		w.Header().Set("X-Thumber-Prescale", strconv.FormatFloat(t.stats.Prescale, 'g', -1, 64))
+	}
+}
+
+// serverTiming formats a Server-Timing metric for a duration, in milliseconds.
+func serverTiming(name string, d time.Duration) string {
+	return fmt.Sprintf("%s;dur=%.3f", name, d.Seconds()*1000)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var allow_hosts = flag.String("allow-hosts", "", "comma-separated upstream hosts to allow, e.g. img.example.com,*.example.net:8080 (empty to allow all)")
+var allow_private_upstreams = flag.Bool("allow-private-upstreams", false, "allow upstream connections to loopback, private and link-local addresses")
+var max_redirects = flag.Int("max-redirects", 3, "number of upstream redirects to follow")
+var upstream_ca = flag.String("upstream-ca", "", "PEM file of CA certificates to trust for HTTPS upstreams, in addition to the system ones")
+var upstream_cert = flag.String("upstream-cert", "", "PEM file of a client certificate to present to HTTPS upstreams")
+var upstream_key = flag.String("upstream-key", "", "PEM file of the private key of -upstream-cert")
+
+var errUpstreamNotAllowed = errors.New("upstream not allowed")
+
+// allowHosts are the patterns (as in path.Match) of the upstream hosts that
+// may be contacted. Patterns with a port match the host and port; others match
+// the host on any port. If empty, all hosts are allowed.
+var allowHosts []string
+
+// client fetches upstream images. Each connection is checked by checkAddress,
+// and each redirect by checkRedirect.
+var client = http.Client{
+	Transport:     newTransport(),
+	CheckRedirect: checkRedirect,
+}
+
+func newTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// Connections are checked by address, which a proxy would hide
+	transport.Proxy = nil
+	transport.DialContext = (&net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   checkAddress,
+	}).DialContext
+	return transport
+}
+
+// configureTLS sets up transport to trust the CA certificates in caFile (if
+// any) as well as the system ones, and to present the client certificate in
+// certFile and keyFile (if any) to upstreams that ask for one.
+func configureTLS(transport *http.Transport, caFile, certFile, keyFile string) error {
+	config := &tls.Config{}
+	if caFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		data, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return err
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("no certificates found in %s", caFile)
+		}
+		config.RootCAs = pool
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	transport.TLSClientConfig = config
+	return nil
+}
+
+// upstreamURL returns the URL of the upstream component of a request path,
+// which is fetched over HTTPS if it starts with "https:/" and over HTTP
+// otherwise.
+func upstreamURL(upstream string) string {
+	for _, scheme := range []string{"https", "http"} {
+		if strings.HasPrefix(upstream, scheme+":/") {
+			// Tolerate the double slash, in case it wasn't collapsed
+			return scheme + "://" + strings.TrimPrefix(upstream[len(scheme)+2:], "/")
+		}
+	}
+	return "http://" + upstream
+}
+
+// parseAllowHosts parses the -allow-hosts flag.
+func parseAllowHosts(s string) ([]string, error) {
+	var patterns []string
+	for _, pattern := range strings.Split(s, ",") {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if pattern == "" {
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid host pattern %q: %v", pattern, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+// checkURL returns an error wrapping errUpstreamNotAllowed unless u may be
+// fetched.
+func checkURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%w: scheme %s", errUpstreamNotAllowed, u.Scheme)
+	}
+	if len(allowHosts) == 0 {
+		return nil
+	}
+	host, hostname := strings.ToLower(u.Host), strings.ToLower(u.Hostname())
+	for _, pattern := range allowHosts {
+		name := hostname
+		if strings.Contains(pattern, ":") {
+			name = host
+		}
+		if ok, _ := path.Match(pattern, name); ok {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: host %s", errUpstreamNotAllowed, u.Host)
+}
+
+// checkRedirect limits the number of redirects, and checks that each one is
+// allowed.
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) > *max_redirects {
+		return fmt.Errorf("stopped after %d redirects", *max_redirects)
+	}
+	return checkURL(req.URL)
+}
+
+// publicIP returns whether ip is an address on the public internet.
+func publicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified())
+}
+
+// checkAddress refuses upstream connections to addresses that aren't public,
+// such as internal services and cloud metadata endpoints. It is called after
+// DNS resolution, so host names that resolve to such addresses are caught too.
+func checkAddress(network, address string, c syscall.RawConn) error {
+	if *allow_private_upstreams {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+		return fmt.Errorf("%w: address %s", errUpstreamNotAllowed, host)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var max_age = flag.Int("max-age", -1, "max-age of thumbnails in the Cache-Control header, in seconds (-1 to pass on the upstream Cache-Control header)")
+
+// keyHash returns a short hash of a cache key.
+func keyHash(cacheKey string) string {
+	sum := sha256.Sum256([]byte(cacheKey))
+	return hex.EncodeToString(sum[:8])
+}
+
+// thumbETag returns the ETag of a thumbnail: a hash of its parameters and
+// upstream, followed by the ETag of its source or, failing that, the time its
+// source was last modified. This lets a request conditional on the thumbnail
+// be passed on to the source. It is weak, since another version of thumberd
+// may make a slightly different thumbnail.
+func thumbETag(cacheKey string, info *sourceInfo, modified time.Time) string {
+	var validator string
+	switch {
+	case strings.HasPrefix(info.etag, `W/"`):
+		validator = "w" + strings.Trim(info.etag[2:], `"`)
+	case strings.HasPrefix(info.etag, `"`):
+		validator = "e" + strings.Trim(info.etag, `"`)
+	default:
+		validator = "m" + strconv.FormatInt(modified.Unix(), 16)
+	}
+	return `W/"` + keyHash(cacheKey) + "-" + validator + `"`
+}
+
+// splitETags splits the list of ETags in an If-None-Match header.
+func splitETags(header string) []string {
+	var tags []string
+	for _, tag := range strings.Split(header, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// sourceConditions returns the conditions for the source of the thumbnail
+// identified by cacheKey corresponding to a request's If-None-Match header
+// (made of ETags from thumbETag), or else its If-Modified-Since header.
+func sourceConditions(r *http.Request, cacheKey string) conditions {
+	var cond conditions
+	if header := r.Header.Get("If-None-Match"); header != "" {
+		prefix := keyHash(cacheKey) + "-"
+		for _, tag := range splitETags(header) {
+			opaque := strings.Trim(strings.TrimPrefix(tag, "W/"), `"`)
+			if !strings.HasPrefix(opaque, prefix) || len(opaque) == len(prefix) {
+				// For another thumbnail, or not ours at all
+				continue
+			}
+			validator := opaque[len(prefix):]
+			switch validator[0] {
+			case 'e':
+				cond.etags = append(cond.etags, `"`+validator[1:]+`"`)
+			case 'w':
+				cond.etags = append(cond.etags, `W/"`+validator[1:]+`"`)
+			case 'm':
+				if sec, err := strconv.ParseInt(validator[1:], 16, 64); err == nil {
+					cond.modified = time.Unix(sec, 0)
+				}
+			}
+		}
+		return cond
+	}
+	if modified, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil {
+		cond.modified = modified
+	}
+	return cond
+}
+
+// notModified returns whether a request's If-None-Match header, or else its
+// If-Modified-Since header, matches t.
+func notModified(r *http.Request, t *thumb) bool {
+	if header := r.Header.Get("If-None-Match"); header != "" {
+		for _, tag := range splitETags(header) {
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(t.etag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+	modified, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	return err == nil && !t.modified.Truncate(time.Second).After(modified)
+}
+
+// setCacheHeaders sets the Last-Modified, ETag and Cache-Control headers for t.
+func setCacheHeaders(w http.ResponseWriter, t *thumb) {
+	w.Header().Set("Last-Modified", t.modified.UTC().Format(http.TimeFormat))
+	w.Header().Set("ETag", t.etag)
+	if *max_age >= 0 {
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", *max_age))
+	} else if t.cacheControl != "" {
+		w.Header().Set("Cache-Control", t.cacheControl)
+	}
+}
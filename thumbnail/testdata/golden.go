@@ -0,0 +1,163 @@
+//go:build ignore
+// +build ignore
+
+// This program writes thumbnails.golden, the hashes of the thumbnails that
+// TestStreamingMatchesBuffered expects. They must be made by MakeThumbnail as
+// it was before it streamed images, which decoded the whole image, cropped
+// it, scaled it with one call to libswscale, padded it and encoded it. Copy
+// this file into the thumbnail/testdata directory of a checkout of the commit
+// before jpeg.Decoder was added, and run it there with:
+//
+//	go run golden.go
+//
+// Then copy thumbnails.golden back. The hashes depend on the versions of
+// libjpeg and libswscale (and of Go's image/jpeg, which makes some of the
+// sources), so the file starts with a fingerprint of them; the test is
+// skipped where it doesn't match.
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"image"
+	"image/color"
+	stdjpeg "image/jpeg"
+	"io/ioutil"
+	"log"
+
+	"github.com/pixiv/go-thumber/jpeg"
+	"github.com/pixiv/go-thumber/swscale"
+	"github.com/pixiv/go-thumber/thumbnail"
+)
+
+// The rest of this file must be kept in sync with thumbnail_test.go.
+
+// encodeTestImage returns a JPEG of a gradient (4:2:0, or grayscale if gray is
+// set) made by the standard library.
+func encodeTestImage(width, height int, gray bool) []byte {
+	var img image.Image
+	if gray {
+		g := image.NewGray(image.Rect(0, 0, width, height))
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				g.SetGray(x, y, color.Gray{uint8((x*7 + y*3) % 256)})
+			}
+		}
+		img = g
+	} else {
+		rgba := image.NewRGBA(image.Rect(0, 0, width, height))
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				rgba.SetRGBA(x, y, color.RGBA{uint8(x % 256), uint8(y % 256), uint8((x + y) % 256), 0xff})
+			}
+		}
+		img = rgba
+	}
+	var buf bytes.Buffer
+	stdjpeg.Encode(&buf, img, &stdjpeg.Options{Quality: 90})
+	return buf.Bytes()
+}
+
+// goldenSources returns the source images of the test matrix by name.
+func goldenSources() (map[string][]byte, error) {
+	sources := map[string][]byte{
+		"420":  encodeTestImage(333, 201, false),
+		"gray": encodeTestImage(201, 333, true),
+	}
+	for _, name := range []string{"test001.jpg", "rgb.jpg", "cmyk-adobe.jpg"} {
+		data, err := ioutil.ReadFile("../../test-image/" + name)
+		if err != nil {
+			return nil, err
+		}
+		sources[name] = data
+	}
+	return sources, nil
+}
+
+// goldenCase is one thumbnail of the test matrix.
+type goldenCase struct {
+	desc   string
+	source string
+	params thumbnail.ThumbnailParameters
+}
+
+// goldenCases returns the test matrix.
+func goldenCases() (cases []goldenCase) {
+	for _, source := range []string{"420", "gray", "test001.jpg", "rgb.jpg", "cmyk-adobe.jpg"} {
+		for _, size := range [][2]int{{128, 128}, {333, 211}, {97, 61}, {5, 3}, {1200, 900}} {
+			for _, format := range []jpeg.PixelFormat{jpeg.YUV444, jpeg.YUV422, jpeg.YUV440, jpeg.YUV420} {
+				for mode := 0; mode < 5; mode++ {
+					params := thumbnail.ThumbnailParameters{
+						Width:          size[0],
+						Height:         size[1],
+						Upscale:        true,
+						Quality:        90,
+						Subsampling:    format,
+						PrescaleFactor: float64(mode % 3),
+					}
+					switch mode {
+					case 1:
+						params.ForceAspect = true
+					case 2:
+						params.Crop = true
+					case 3:
+						params.Crop = true
+						params.Gravity = thumbnail.SouthEast
+					case 4:
+						params.Pad = true
+						params.Background = color.RGBA{0x20, 0x40, 0x80, 0xff}
+					}
+					desc := fmt.Sprintf("%s %dx%d format %d mode %d", source, size[0], size[1], format, mode)
+					cases = append(cases, goldenCase{desc, source, params})
+				}
+			}
+		}
+	}
+	return
+}
+
+// goldenFingerprint hashes the sources and an image decoded, scaled and
+// encoded without MakeThumbnail, to tell whether the golden hashes were made
+// with the same libraries.
+func goldenFingerprint(sources map[string][]byte) (string, error) {
+	h := sha256.New()
+	for _, name := range []string{"420", "gray"} {
+		h.Write(sources[name])
+	}
+	img, err := jpeg.ReadJPEG(bytes.NewReader(sources["test001.jpg"]), jpeg.DecompressionParameters{TargetWidth: 150, TargetHeight: 100})
+	if err != nil {
+		return "", err
+	}
+	img, err = swscale.Scale(img, swscale.ScaleOptions{DstWidth: 97, DstHeight: 61, DstFormat: jpeg.YUV444, Filter: swscale.Lanczos})
+	if err != nil {
+		return "", err
+	}
+	if err := jpeg.WriteJPEG(img, h, jpeg.CompressionParameters{Quality: 90}); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+func main() {
+	sources, err := goldenSources()
+	if err != nil {
+		log.Fatal(err)
+	}
+	fingerprint, err := goldenFingerprint(sources)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "fingerprint\t%s\n", fingerprint)
+	for _, c := range goldenCases() {
+		var buf bytes.Buffer
+		if err := thumbnail.MakeThumbnail(bytes.NewReader(sources[c.source]), &buf, c.params); err != nil {
+			log.Fatal(c.desc, err)
+		}
+		fmt.Fprintf(&out, "%s\t%x\n", c.desc, sha256.Sum256(buf.Bytes()))
+	}
+	if err := ioutil.WriteFile("thumbnails.golden", out.Bytes(), 0644); err != nil {
+		log.Fatal(err)
+	}
+}
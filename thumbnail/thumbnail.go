@@ -3,64 +3,414 @@
 package thumbnail
 
 import (
+	"context"
+	"fmt"
+	"image/color"
 	"io"
 	"math"
+	"time"
 
 	"github.com/pixiv/go-thumber/jpeg"
 	"github.com/pixiv/go-thumber/swscale"
 )
 
+// Gravity specifies which part of the image is kept when cropping.
+type Gravity int
+
+// Valid Gravity values
+const (
+	Center Gravity = iota
+	North
+	South
+	East
+	West
+	NorthEast
+	NorthWest
+	SouthEast
+	SouthWest
+)
+
+var gravityNames = map[string]Gravity{
+	"c":  Center,
+	"n":  North,
+	"s":  South,
+	"e":  East,
+	"w":  West,
+	"ne": NorthEast,
+	"nw": NorthWest,
+	"se": SouthEast,
+	"sw": SouthWest,
+}
+
+// ParseGravity parses a gravity name (c, n, s, e, w, ne, nw, se or sw).
+func ParseGravity(name string) (Gravity, error) {
+	g, ok := gravityNames[name]
+	if !ok {
+		return Center, fmt.Errorf("invalid gravity: %q", name)
+	}
+	return g, nil
+}
+
+var subsamplingNames = map[string]jpeg.PixelFormat{
+	"444": jpeg.YUV444,
+	"422": jpeg.YUV422,
+	"440": jpeg.YUV440,
+	"420": jpeg.YUV420,
+}
+
+// ParseSubsampling parses a chroma subsampling mode (444, 422, 440 or 420).
+func ParseSubsampling(name string) (jpeg.PixelFormat, error) {
+	f, ok := subsamplingNames[name]
+	if !ok {
+		return jpeg.YUV444, fmt.Errorf("invalid subsampling: %q", name)
+	}
+	return f, nil
+}
+
 // ThumbnailParameters configures the thumbnailing process
 type ThumbnailParameters struct {
-	Width          int     // Target width
-	Height         int     // Target height
-	Upscale        bool    // Whether to upscale images that are smaller than the target
-	ForceAspect    bool    // Whether the source aspect ratio should be preserved
-	Quality        int     // JPEG quality (0-99)
-	Optimize       bool    // Whether to optimize the JPEG huffman tables
-	PrescaleFactor float64 // Controls whether optimized JPEG prescaling is used and how much.
+	Width          int                 // Target width
+	Height         int                 // Target height
+	Upscale        bool                // Whether to upscale images that are smaller than the target
+	ForceAspect    bool                // Whether the source aspect ratio should be preserved
+	Crop           bool                // Whether to scale to cover the target and crop the overflow (overrides ForceAspect)
+	Gravity        Gravity             // Which part of the image to keep when cropping
+	Pad            bool                // Whether to keep aspect and center the image on a Width x Height canvas (ignored if Crop)
+	Background     color.Color         // Canvas color when padding (default black)
+	NoOrient       bool                // Whether to ignore the EXIF orientation tag instead of rotating the image to match it
+	Quality        int                 // JPEG quality (0-99)
+	Optimize       bool                // Whether to optimize the JPEG huffman tables
+	Progressive    bool                // Whether to write a progressive JPEG
+	Subsampling    jpeg.PixelFormat    // Output format for color images (YUV444 if left as Grayscale)
+	Metadata       jpeg.MetadataPolicy // Which source metadata (ICC, EXIF, XMP, comments) to keep
+	PrescaleFactor float64             // Controls whether optimized JPEG prescaling is used and how much.
+
+	// Limits on the source image; see jpeg.DecompressionParameters
+	MaxSourcePixels int64
+	MaxScans        int
+	MaxMemory       int64
+}
+
+// cropRect returns the rectangle of a width x height image with the aspect
+// ratio of targetWidth x targetHeight, keeping the part of the image specified
+// by gravity.
+func cropRect(width, height, targetWidth, targetHeight int, gravity Gravity) (x, y, cropWidth, cropHeight int) {
+	cropWidth, cropHeight = width, height
+	if width*targetHeight > height*targetWidth {
+		cropWidth = int(float64(height*targetWidth)/float64(targetHeight) + 0.5)
+		if cropWidth <= 0 {
+			cropWidth = 1
+		}
+	} else {
+		cropHeight = int(float64(width*targetHeight)/float64(targetWidth) + 0.5)
+		if cropHeight <= 0 {
+			cropHeight = 1
+		}
+	}
+
+	x = (width - cropWidth) / 2
+	y = (height - cropHeight) / 2
+	switch gravity {
+	case West, NorthWest, SouthWest:
+		x = 0
+	case East, NorthEast, SouthEast:
+		x = width - cropWidth
+	}
+	switch gravity {
+	case North, NorthEast, NorthWest:
+		y = 0
+	case South, SouthEast, SouthWest:
+		y = height - cropHeight
+	}
+	return
+}
+
+// alignOffset rounds x and y down to the nearest chroma sample boundary of
+// format, as YUVImage.Crop and YUVImage.Draw do.
+func alignOffset(x, y int, format jpeg.PixelFormat) (int, int) {
+	if format == jpeg.YUV422 || format == jpeg.YUV420 {
+		x &^= 1
+	}
+	if format == jpeg.YUV440 || format == jpeg.YUV420 {
+		y &^= 1
+	}
+	return x, y
+}
+
+// layout describes how a source image is cropped, scaled and padded to make a
+// thumbnail.
+type layout struct {
+	cropX, cropY, cropWidth, cropHeight int                  // Part of the source image to use
+	scale                               bool                 // Whether the cropped image needs scaling
+	opts                                swscale.ScaleOptions // How to scale it
+	width, height                       int                  // Size of the (scaled) image
+	format                              jpeg.PixelFormat     // Format of the (scaled) image
+	pad                                 bool                 // Whether to pad the image to the canvas size
+	canvasWidth, canvasHeight           int                  // Size of the thumbnail
+}
+
+// makeLayout works out the layout of a thumbnail of img (whose pixel data is
+// not used).
+func makeLayout(img *jpeg.YUVImage, params ThumbnailParameters) (l layout) {
+	width, height := img.Width, img.Height
+	l.cropWidth, l.cropHeight = width, height
+
+	if params.Crop {
+		if !params.Upscale && (width < params.Width || height < params.Height) {
+			// Shrink the target box to fit within the source, keeping its aspect
+			factor := math.Min(float64(width)/float64(params.Width),
+				float64(height)/float64(params.Height))
+			params.Width = int(math.Max(1, float64(params.Width)*factor+0.5))
+			params.Height = int(math.Max(1, float64(params.Height)*factor+0.5))
+		}
+		l.cropX, l.cropY, l.cropWidth, l.cropHeight = cropRect(width, height, params.Width, params.Height, params.Gravity)
+		l.cropX, l.cropY = alignOffset(l.cropX, l.cropY, img.Format)
+		width, height = l.cropWidth, l.cropHeight
+		params.ForceAspect = true
+		params.Pad = false
+	}
+
+	canvasWidth, canvasHeight := params.Width, params.Height
+	if params.Pad {
+		params.ForceAspect = false
+	}
+
+	if !params.Upscale && !params.ForceAspect &&
+		width < params.Width && height < params.Height {
+		params.Width = width
+		params.Height = height
+	}
+
+	format := params.Subsampling
+	if img.Format == jpeg.Grayscale {
+		format = jpeg.Grayscale
+	} else if format == jpeg.Grayscale {
+		format = jpeg.YUV444
+	}
+
+	l.width, l.height, l.format = width, height, img.Format
+	if width != params.Width || height != params.Height || img.Format != format {
+		l.scale = true
+		l.opts.DstWidth = params.Width
+		l.opts.DstHeight = params.Height
+		l.opts.DstFormat = format
+		if !params.ForceAspect {
+			if l.opts.DstWidth > params.Height*width/height {
+				l.opts.DstWidth = int(float64(params.Height*width)/float64(height) + 0.5)
+				if l.opts.DstWidth <= 0 {
+					l.opts.DstWidth = 1
+				}
+			} else if l.opts.DstHeight > params.Width*height/width {
+				l.opts.DstHeight = int(float64(params.Width*height)/float64(width) + 0.5)
+				if l.opts.DstHeight <= 0 {
+					l.opts.DstHeight = 1
+				}
+			}
+		}
+		l.opts.Filter = swscale.Lanczos
+		l.width, l.height, l.format = l.opts.DstWidth, l.opts.DstHeight, format
+	}
+
+	l.canvasWidth, l.canvasHeight = l.width, l.height
+	if params.Pad && (l.width != canvasWidth || l.height != canvasHeight) {
+		l.pad = true
+		l.canvasWidth, l.canvasHeight = canvasWidth, canvasHeight
+	}
+	return
+}
+
+// background returns bg as YCbCr, defaulting to black.
+func background(bg color.Color) color.YCbCr {
+	if bg == nil {
+		bg = color.Black
+	}
+	return color.YCbCrModel.Convert(bg).(color.YCbCr)
+}
+
+// padToSize centers img on a width x height canvas filled with bg.
+func padToSize(img *jpeg.YUVImage, width, height int, bg color.Color) *jpeg.YUVImage {
+	c := background(bg)
+	canvas := jpeg.NewYUVImage(width, height, img.Format)
+	canvas.Fill(c.Y, c.Cb, c.Cr)
+	canvas.Draw(img, (width-img.Width)/2, (height-img.Height)/2)
+	canvas.ReplicateEdges()
+	canvas.Orientation = img.Orientation
+	canvas.Markers = img.Markers
+	return canvas
+}
+
+// Number of background rows written at a time by padder
+const padRows = 16
+
+// padder centers bands of rows on a canvas filled with a background color as
+// they are written to enc, like padToSize does for a whole image.
+type padder struct {
+	enc                       *jpeg.Encoder
+	bg                        color.YCbCr
+	format                    jpeg.PixelFormat
+	canvasWidth, canvasHeight int
+	x, y, height              int // Position and height of the image on the canvas
+	row                       int // Canvas rows written so far
+	buf                       *jpeg.YUVImage
+}
+
+func newPadder(enc *jpeg.Encoder, l layout, bg color.Color) *padder {
+	p := &padder{enc: enc, bg: background(bg), format: l.format,
+		canvasWidth: l.canvasWidth, canvasHeight: l.canvasHeight, height: l.height}
+	p.x, p.y = alignOffset((l.canvasWidth-l.width)/2, (l.canvasHeight-l.height)/2, l.format)
+	return p
+}
+
+// rows returns a band of rows rows of background.
+func (p *padder) rows(rows int) *jpeg.YUVImage {
+	if p.buf == nil || p.buf.Height < rows {
+		p.buf = jpeg.NewYUVImage(p.canvasWidth, rows, p.format)
+	}
+	p.buf.Fill(p.bg.Y, p.bg.Cb, p.bg.Cr)
+	band := *p.buf
+	band.Height = rows
+	return &band
+}
+
+// fill writes background rows up to canvas row end.
+func (p *padder) fill(end int) error {
+	for p.row < end {
+		rows := end - p.row
+		if rows > padRows {
+			rows = padRows
+		}
+		if err := p.enc.WriteRows(p.rows(rows)); err != nil {
+			return err
+		}
+		p.row += rows
+	}
+	return nil
+}
+
+// WriteRows writes the next band of rows of the image, with the background
+// around it.
+func (p *padder) WriteRows(img *jpeg.YUVImage) error {
+	if err := p.fill(p.y); err != nil {
+		return err
+	}
+	rows := img.Height
+	last := p.row+rows == p.y+p.height
+	if last && rows%2 == 1 && p.row+rows < p.canvasHeight &&
+		(p.format == jpeg.YUV440 || p.format == jpeg.YUV420) {
+		// The next row of background shares chroma samples with the last
+		// row of the image, so write them together
+		rows++
+	}
+	band := p.rows(rows)
+	band.Draw(img, p.x, 0)
+	if err := p.enc.WriteRows(band); err != nil {
+		return err
+	}
+	p.row += rows
+	if last {
+		return p.fill(p.canvasHeight)
+	}
+	return nil
+}
+
+// Stats describes how a thumbnail was made. When the image is streamed, the
+// phases are interleaved, and each time is the total spent in that phase.
+type Stats struct {
+	DecodeTime time.Duration // Reading and decoding the source
+	ScaleTime  time.Duration // Cropping, rotating, scaling and padding
+	EncodeTime time.Duration // Encoding and writing the thumbnail
+
+	SourceWidth, SourceHeight   int     // Of the source, as stored
+	DecodedWidth, DecodedHeight int     // Of the source as decoded, after prescaling
+	Prescale                    float64 // Factor by which libjpeg prescaled the source
+	Width, Height               int     // Of the thumbnail
+}
+
+// since adds the time since start to *d, and returns the current time.
+func since(d *time.Duration, start time.Time) time.Time {
+	now := time.Now()
+	*d += now.Sub(start)
+	return now
 }
 
 // MakeThumbnail makes a thumbnail of a JPEG stream at src and writes it to dst.
 func MakeThumbnail(src io.Reader, dst io.Writer, params ThumbnailParameters) error {
+	return MakeThumbnailContext(context.Background(), src, dst, params)
+}
+
+// MakeThumbnailContext is like MakeThumbnail, but stops work and returns
+// ctx.Err() once ctx is done.
+//
+// Where possible, the image is decoded, scaled and encoded a band of rows at a
+// time, so that memory use is proportional to the width of the image rather
+// than its size. Images that need rotating by their EXIF orientation, or no
+// scaling at all, are held in memory as a whole.
+func MakeThumbnailContext(ctx context.Context, src io.Reader, dst io.Writer, params ThumbnailParameters) error {
+	return makeThumbnail(ctx, src, dst, params, true, &Stats{})
+}
+
+// MakeThumbnailStats is like MakeThumbnailContext, but also returns how the
+// thumbnail was made, as far as it got if it failed.
+func MakeThumbnailStats(ctx context.Context, src io.Reader, dst io.Writer, params ThumbnailParameters) (Stats, error) {
+	var stats Stats
+	err := makeThumbnail(ctx, src, dst, params, true, &stats)
+	return stats, err
+}
+
+func makeThumbnail(ctx context.Context, src io.Reader, dst io.Writer, params ThumbnailParameters, stream bool, stats *Stats) error {
+	t := time.Now()
 	var dparams jpeg.DecompressionParameters
 	if params.PrescaleFactor > 0 {
 		dparams.TargetWidth = int(math.Ceil(float64(params.Width) * params.PrescaleFactor))
 		dparams.TargetHeight = int(math.Ceil(float64(params.Height) * params.PrescaleFactor))
 	}
-	img, err := jpeg.ReadJPEG(src, dparams)
+	dparams.Oriented = !params.NoOrient
+	dparams.SaveMarkers = params.Metadata != jpeg.StripMetadata
+	dparams.MaxSourcePixels = params.MaxSourcePixels
+	dparams.MaxScans = params.MaxScans
+	dparams.MaxMemory = params.MaxMemory
+	d, err := jpeg.NewDecoder(ctx, src, dparams)
+	t = since(&stats.DecodeTime, t)
 	if err != nil {
 		return err
 	}
-	//fmt.Printf("%dx%d\n", img.Width, img.Height);
+	defer d.Close()
+	stats.SourceWidth, stats.SourceHeight = d.SourceSize()
+	num, denom := d.Prescale()
+	stats.Prescale = float64(num) / float64(denom)
+	stats.DecodedWidth, stats.DecodedHeight = d.Header().Width, d.Header().Height
 
-	if !params.Upscale && !params.ForceAspect &&
-		img.Width < params.Width && img.Height < params.Height {
-		params.Width = img.Width
-		params.Height = img.Height
+	var cparams jpeg.CompressionParameters
+
+	cparams.Optimize = params.Optimize
+	cparams.Progressive = params.Progressive
+	cparams.Quality = params.Quality
+	cparams.Metadata = params.Metadata
+
+	img := d.Header()
+	if !params.NoOrient && img.Orientation > jpeg.OrientationNormal && img.Orientation <= jpeg.OrientationRotate270 {
+		// Rotating needs the whole image
+		stream = false
+	}
+	l := makeLayout(img, params)
+	if stream && l.scale {
+		return streamThumbnail(ctx, d, dst, l, params.Background, cparams, stats)
 	}
 
-	if img.Width != params.Width || img.Height != params.Height ||
-		(img.Format != jpeg.YUV444 && img.Format != jpeg.Grayscale) {
+	img, err = d.ReadImage()
+	t = since(&stats.DecodeTime, t)
+	if err != nil {
+		return err
+	}
+	if !params.NoOrient {
+		img = img.ApplyOrientation()
+		l = makeLayout(img, params)
+	}
+	//fmt.Printf("%dx%d\n", img.Width, img.Height);
 
-		var opts swscale.ScaleOptions
-		opts.DstWidth = params.Width
-		opts.DstHeight = params.Height
-		if !params.ForceAspect {
-			if opts.DstWidth > params.Height*img.Width/img.Height {
-				opts.DstWidth = int(float64(params.Height*img.Width)/float64(img.Height) + 0.5)
-				if opts.DstWidth <= 0 {
-					opts.DstWidth = 1
-				}
-			} else if opts.DstHeight > params.Width*img.Height/img.Width {
-				opts.DstHeight = int(float64(params.Width*img.Height)/float64(img.Width) + 0.5)
-				if opts.DstHeight <= 0 {
-					opts.DstHeight = 1
-				}
-			}
-		}
-		opts.Filter = swscale.Lanczos
-		img, err = swscale.Scale(img, opts)
+	img = img.Crop(l.cropX, l.cropY, l.cropWidth, l.cropHeight)
+	if l.scale {
+		img, err = swscale.ScaleContext(ctx, img, l.opts)
 		if err != nil {
 			return err
 		}
@@ -68,10 +418,79 @@ func MakeThumbnail(src io.Reader, dst io.Writer, params ThumbnailParameters) err
 
 	//fmt.Printf("%dx%d\n", img.Width, img.Height);
 
-	var cparams jpeg.CompressionParameters
+	if l.pad {
+		img = padToSize(img, l.canvasWidth, l.canvasHeight, params.Background)
+	}
+	t = since(&stats.ScaleTime, t)
+	stats.Width, stats.Height = img.Width, img.Height
 
-	cparams.Optimize = params.Optimize
-	cparams.Quality = params.Quality
+	err = jpeg.WriteJPEGContext(ctx, img, dst, cparams)
+	since(&stats.EncodeTime, t)
+	return err
+}
+
+// streamThumbnail makes a thumbnail as laid out by l, passing bands of rows
+// from d through the scaler (and padder) to the encoder.
+func streamThumbnail(ctx context.Context, d *jpeg.Decoder, dst io.Writer, l layout, bg color.Color, cparams jpeg.CompressionParameters, stats *Stats) error {
+	img := d.Header()
+
+	t := time.Now()
+	s, err := swscale.NewScaler(&jpeg.YUVImage{Width: l.cropWidth, Height: l.cropHeight, Format: img.Format}, l.opts)
+	t = since(&stats.ScaleTime, t)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	thumb := &jpeg.YUVImage{Width: l.canvasWidth, Height: l.canvasHeight, Format: l.format,
+		Orientation: img.Orientation, Markers: img.Markers}
+	stats.Width, stats.Height = thumb.Width, thumb.Height
+	e, err := jpeg.NewEncoder(ctx, dst, thumb, cparams)
+	t = since(&stats.EncodeTime, t)
+	if err != nil {
+		return err
+	}
+	defer e.Close()
 
-	return jpeg.WriteJPEG(img, dst, cparams)
+	var w interface {
+		WriteRows(*jpeg.YUVImage) error
+	} = e
+	if l.pad {
+		w = newPadder(e, l, bg)
+	}
+
+	// Rows outside of the crop rectangle are skipped; there is no need to
+	// decode any beyond it.
+	for y := 0; y < l.cropY+l.cropHeight; {
+		band, err := d.ReadRows()
+		t = since(&stats.DecodeTime, t)
+		if err != nil {
+			return err
+		}
+		top, bottom := y, y+band.Height
+		y = bottom
+		if top < l.cropY {
+			top = l.cropY
+		}
+		if bottom > l.cropY+l.cropHeight {
+			bottom = l.cropY + l.cropHeight
+		}
+		if top >= bottom {
+			continue
+		}
+		scaled, err := s.ScaleRows(band.Crop(l.cropX, top-(y-band.Height), l.cropWidth, bottom-top))
+		t = since(&stats.ScaleTime, t)
+		if err != nil {
+			return err
+		}
+		if scaled.Height == 0 {
+			continue
+		}
+		err = w.WriteRows(scaled)
+		t = since(&stats.EncodeTime, t)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
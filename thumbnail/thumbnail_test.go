@@ -0,0 +1,221 @@
+package thumbnail
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"image"
+	"image/color"
+	stdjpeg "image/jpeg"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/pixiv/go-thumber/jpeg"
+	"github.com/pixiv/go-thumber/swscale"
+)
+
+// encodeTestImage returns a JPEG of a gradient (4:2:0, or grayscale if gray is
+// set) made by the standard library.
+func encodeTestImage(width, height int, gray bool) []byte {
+	var img image.Image
+	if gray {
+		g := image.NewGray(image.Rect(0, 0, width, height))
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				g.SetGray(x, y, color.Gray{uint8((x*7 + y*3) % 256)})
+			}
+		}
+		img = g
+	} else {
+		rgba := image.NewRGBA(image.Rect(0, 0, width, height))
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				rgba.SetRGBA(x, y, color.RGBA{uint8(x % 256), uint8(y % 256), uint8((x + y) % 256), 0xff})
+			}
+		}
+		img = rgba
+	}
+	var buf bytes.Buffer
+	stdjpeg.Encode(&buf, img, &stdjpeg.Options{Quality: 90})
+	return buf.Bytes()
+}
+
+// goldenSources returns the source images of the test matrix by name.
+func goldenSources() (map[string][]byte, error) {
+	sources := map[string][]byte{
+		"420":  encodeTestImage(333, 201, false),
+		"gray": encodeTestImage(201, 333, true),
+	}
+	for _, name := range []string{"test001.jpg", "rgb.jpg", "cmyk-adobe.jpg"} {
+		data, err := ioutil.ReadFile("../test-image/" + name)
+		if err != nil {
+			return nil, err
+		}
+		sources[name] = data
+	}
+	return sources, nil
+}
+
+// goldenCase is one thumbnail of the test matrix.
+type goldenCase struct {
+	desc   string
+	source string
+	params ThumbnailParameters
+}
+
+// goldenCases returns the test matrix. It must be kept in sync with
+// testdata/golden.go, which made the hashes of its thumbnails.
+func goldenCases() (cases []goldenCase) {
+	for _, source := range []string{"420", "gray", "test001.jpg", "rgb.jpg", "cmyk-adobe.jpg"} {
+		for _, size := range [][2]int{{128, 128}, {333, 211}, {97, 61}, {5, 3}, {1200, 900}} {
+			for _, format := range []jpeg.PixelFormat{jpeg.YUV444, jpeg.YUV422, jpeg.YUV440, jpeg.YUV420} {
+				for mode := 0; mode < 5; mode++ {
+					params := ThumbnailParameters{
+						Width:          size[0],
+						Height:         size[1],
+						Upscale:        true,
+						Quality:        90,
+						Subsampling:    format,
+						PrescaleFactor: float64(mode % 3),
+					}
+					switch mode {
+					case 1:
+						params.ForceAspect = true
+					case 2:
+						params.Crop = true
+					case 3:
+						params.Crop = true
+						params.Gravity = SouthEast
+					case 4:
+						params.Pad = true
+						params.Background = color.RGBA{0x20, 0x40, 0x80, 0xff}
+					}
+					desc := fmt.Sprintf("%s %dx%d format %d mode %d", source, size[0], size[1], format, mode)
+					cases = append(cases, goldenCase{desc, source, params})
+				}
+			}
+		}
+	}
+	return
+}
+
+// goldenFingerprint hashes the sources and an image decoded, scaled and
+// encoded without MakeThumbnail, to tell whether the golden hashes were made
+// with the same libraries.
+func goldenFingerprint(sources map[string][]byte) (string, error) {
+	h := sha256.New()
+	for _, name := range []string{"420", "gray"} {
+		h.Write(sources[name])
+	}
+	img, err := jpeg.ReadJPEG(bytes.NewReader(sources["test001.jpg"]), jpeg.DecompressionParameters{TargetWidth: 150, TargetHeight: 100})
+	if err != nil {
+		return "", err
+	}
+	img, err = swscale.Scale(img, swscale.ScaleOptions{DstWidth: 97, DstHeight: 61, DstFormat: jpeg.YUV444, Filter: swscale.Lanczos})
+	if err != nil {
+		return "", err
+	}
+	if err := jpeg.WriteJPEG(img, h, jpeg.CompressionParameters{Quality: 90}); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// TestStreamingMatchesBuffered checks that both the streaming and the
+// buffered pipelines make exactly the thumbnails that MakeThumbnail made
+// before it streamed images, whose hashes are in testdata/thumbnails.golden.
+func TestStreamingMatchesBuffered(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/thumbnails.golden")
+	if err != nil {
+		t.Fatal(err)
+	}
+	golden := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		tup := strings.SplitN(line, "\t", 2)
+		if len(tup) != 2 {
+			t.Fatalf("Bad golden line %q", line)
+		}
+		golden[tup[0]] = tup[1]
+	}
+
+	sources, err := goldenSources()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fingerprint, err := goldenFingerprint(sources)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fingerprint != golden["fingerprint"] {
+		t.Skip("The golden hashes were made with other versions of libjpeg, libswscale or image/jpeg; see testdata/golden.go to remake them")
+	}
+
+	for _, c := range goldenCases() {
+		want, ok := golden[c.desc]
+		if !ok {
+			t.Error("No golden hash for", c.desc)
+			continue
+		}
+		var streamed, buffered bytes.Buffer
+		if err := makeThumbnail(context.Background(), bytes.NewReader(sources[c.source]), &streamed, c.params, true, &Stats{}); err != nil {
+			t.Fatal(c.desc, err)
+		}
+		if err := makeThumbnail(context.Background(), bytes.NewReader(sources[c.source]), &buffered, c.params, false, &Stats{}); err != nil {
+			t.Fatal(c.desc, err)
+		}
+		if fmt.Sprintf("%x", sha256.Sum256(streamed.Bytes())) != want {
+			t.Error("Streamed thumbnail differs from the golden one:", c.desc)
+		}
+		if fmt.Sprintf("%x", sha256.Sum256(buffered.Bytes())) != want {
+			t.Error("Buffered thumbnail differs from the golden one:", c.desc)
+		}
+	}
+}
+
+func TestMakeThumbnailStats(t *testing.T) {
+	data := encodeTestImage(800, 600, false)
+	params := ThumbnailParameters{Width: 100, Height: 75, Quality: 90, PrescaleFactor: 2}
+	stats, err := MakeThumbnailStats(context.Background(), bytes.NewReader(data), ioutil.Discard, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.SourceWidth != 800 || stats.SourceHeight != 600 {
+		t.Errorf("Source is %dx%d, expected 800x600", stats.SourceWidth, stats.SourceHeight)
+	}
+	// libjpeg scales by eighths, down to the first size at least twice
+	// the thumbnail
+	if stats.DecodedWidth != 200 || stats.DecodedHeight != 150 || stats.Prescale != 0.25 {
+		t.Errorf("Decoded at %dx%d (prescaled by %v), expected 200x150 (0.25)", stats.DecodedWidth, stats.DecodedHeight, stats.Prescale)
+	}
+	if stats.Width != 100 || stats.Height != 75 {
+		t.Errorf("Thumbnail is %dx%d, expected 100x75", stats.Width, stats.Height)
+	}
+	if stats.DecodeTime <= 0 || stats.ScaleTime <= 0 || stats.EncodeTime <= 0 {
+		t.Errorf("Phases not timed: %+v", stats)
+	}
+}
+
+// Memory benchmarks: compare the B/op of the streaming and buffered pipelines
+// for a 12 megapixel source.
+
+func benchmarkMakeThumbnail(b *testing.B, stream bool) {
+	data := encodeTestImage(4000, 3000, false)
+	params := ThumbnailParameters{Width: 800, Height: 600, Quality: 90, Subsampling: jpeg.YUV420}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := makeThumbnail(context.Background(), bytes.NewReader(data), ioutil.Discard, params, stream, &Stats{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMakeThumbnailStreaming(b *testing.B) {
+	benchmarkMakeThumbnail(b, true)
+}
+
+func BenchmarkMakeThumbnailBuffered(b *testing.B) {
+	benchmarkMakeThumbnail(b, false)
+}
@@ -0,0 +1,132 @@
+// Package urlsign signs thumberd URLs, so that thumberd only makes the
+// thumbnails it was asked for by someone who knows a shared secret.
+//
+// A signed path has the form
+//
+//	/w=128,h=128,e=1700000000,sig=SIGNATURE/upstream-host.com/some-image.jpg
+//
+// where SIGNATURE is the unpadded URL-safe base64 HMAC-SHA256 of the path
+// without the sig argument, and the optional e argument is the Unix time after
+// which the path expires. The sig argument must come last.
+package urlsign
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidPath  = errors.New("path needs to have at least two components")
+	ErrUnsigned     = errors.New("path is not signed")
+	ErrBadSignature = errors.New("signature does not match")
+	ErrExpired      = errors.New("signature has expired")
+)
+
+// split splits path into its argument segment and the rest.
+func split(path string) (args, rest string, err error) {
+	if !strings.HasPrefix(path, "/") {
+		return "", "", ErrInvalidPath
+	}
+	parts := strings.SplitN(path[1:], "/", 2)
+	if len(parts) < 2 {
+		return "", "", ErrInvalidPath
+	}
+	return parts[0], parts[1], nil
+}
+
+func signature(key []byte, args, rest string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("/" + args + "/" + rest))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Sign returns path signed with key. If expires is not zero, the signed path
+// is only valid until then.
+func Sign(key []byte, path string, expires time.Time) (string, error) {
+	args, rest, err := split(path)
+	if err != nil {
+		return "", err
+	}
+	if !expires.IsZero() {
+		args += ",e=" + strconv.FormatInt(expires.Unix(), 10)
+	}
+	args = strings.TrimPrefix(args, ",")
+	return "/" + args + ",sig=" + signature(key, args, rest) + "/" + rest, nil
+}
+
+// Verify checks that path was signed with one of keys, and has not expired at
+// now.
+func Verify(keys [][]byte, path string, now time.Time) error {
+	args, rest, err := split(path)
+	if err != nil {
+		return err
+	}
+	var sig string
+	if i := strings.LastIndex(args, ","); i >= 0 {
+		args, sig = args[:i], args[i+1:]
+	} else {
+		args, sig = "", args
+	}
+	if !strings.HasPrefix(sig, "sig=") {
+		return ErrUnsigned
+	}
+	sig = sig[len("sig="):]
+
+	valid := false
+	for _, key := range keys {
+		if hmac.Equal([]byte(sig), []byte(signature(key, args, rest))) {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return ErrBadSignature
+	}
+
+	for _, arg := range strings.Split(args, ",") {
+		if !strings.HasPrefix(arg, "e=") {
+			continue
+		}
+		expires, err := strconv.ParseInt(arg[len("e="):], 10, 64)
+		if err != nil || now.Unix() > expires {
+			return ErrExpired
+		}
+	}
+	return nil
+}
+
+// ReadKeys reads secret keys from a file, one per line. Blank lines and lines
+// starting with # are ignored. To rotate keys, add the new key as the first
+// line, which Sign callers should use, and remove the old one once the URLs
+// signed with it are no longer needed.
+func ReadKeys(filename string) ([][]byte, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var keys [][]byte
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		keys = append(keys, []byte(line))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no keys in " + filename)
+	}
+	return keys, nil
+}